@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// buildInfoPath is where fsify records how an image was built, relative to the rootfs.
+const buildInfoPath = "etc/fsify/build.json"
+
+// buildInfo is the record embedded in every image and read back by `fsify inspect`.
+type buildInfo struct {
+	Source         string              `json:"source"`
+	Digest         string              `json:"digest,omitempty"`      // Manifest digest the image was pulled by
+	LocalDigest    string              `json:"localDigest,omitempty"` // Manifest digest of a docker-daemon copy, not in any registry
+	ConfigDigest   string              `json:"configDigest,omitempty"`
+	Layers         []string            `json:"layers,omitempty"` // Layer digests, bottom to top
+	Platform       string              `json:"platform,omitempty"`
+	FsifyVersion   string              `json:"fsifyVersion"`
+	FsifyBuildDate string              `json:"fsifyBuildDate"`
+	Timestamp      string              `json:"timestamp"`
+	Options        buildOptions        `json:"options"`
+	Overlays       []overlayInfo       `json:"overlays,omitempty"`       // --overlay images, in the order applied
+	EntrypointFrom string              `json:"entrypointFrom,omitempty"` // Overlay whose Entrypoint and Cmd were kept
+	Runtime        *runtimeTranslation `json:"runtime,omitempty"`        // How the image config was carried over
+	Added          []addedContent      `json:"added,omitempty"`          // --add and --add-tar, in the order applied
+}
+
+// buildOptions are the conversion settings that shaped the image.
+type buildOptions struct {
+	Filesystem  string        `json:"filesystem"`
+	BufferMB    int           `json:"bufferMB"`
+	Preallocate bool          `json:"preallocate,omitempty"`
+	DualOutput  bool          `json:"dualOutput,omitempty"`
+	Stream      bool          `json:"stream,omitempty"`
+	Size        int64         `json:"size,omitempty"`
+	FreeSpace   int64         `json:"freeSpace,omitempty"`
+	FreePercent float64       `json:"freePercent,omitempty"`
+	MinInodes   int64         `json:"minInodes,omitempty"`
+	Tuning      fsOptions     `json:"tuning"`
+	Signed      bool          `json:"signatureVerified,omitempty"`
+	Exclude     []string      `json:"exclude,omitempty"` // Effective patterns, including --slim
+	Guest       *guestConfig  `json:"guest,omitempty"`
+	Access      *accessConfig `json:"access,omitempty"`
+}
+
+// newBuildInfo captures the build record for the current conversion.
+func newBuildInfo(ctx *ConversionContext) *buildInfo {
+	info := &buildInfo{
+		Source:         ctx.ImageRef,
+		FsifyVersion:   Version,
+		FsifyBuildDate: BuildDate,
+		Options: buildOptions{
+			Filesystem:  ctx.FsType,
+			BufferMB:    ctx.BufferSize,
+			Preallocate: ctx.Preallocate,
+			DualOutput:  ctx.DualOutput,
+			Stream:      ctx.Stream,
+			Size:        ctx.TargetSize,
+			FreeSpace:   ctx.FreeSpace,
+			FreePercent: ctx.FreePercent,
+			MinInodes:   ctx.MinInodes,
+			Tuning:      ctx.FsOptions,
+			Signed:      ctx.Signature.enabled(),
+			Guest:       ctx.Guest,
+			Access:      ctx.Access,
+		},
+		Timestamp:      buildTime(ctx).Format(time.RFC3339),
+		EntrypointFrom: ctx.EntrypointFrom,
+		Runtime:        ctx.Runtime,
+		Added:          ctx.Added,
+	}
+	for _, overlay := range ctx.Overlays {
+		record := overlayInfo{Source: overlay.Ref, Digest: overlay.Digest}
+		if overlay.Manifest != nil {
+			record.ConfigDigest = overlay.Manifest.Config.Digest
+			for _, layer := range overlay.Manifest.Layers {
+				record.Layers = append(record.Layers, layer.Digest)
+			}
+		}
+		info.Overlays = append(info.Overlays, record)
+	}
+	if ctx.Exclude != nil {
+		info.Options.Exclude = ctx.Exclude.patterns
+	}
+	info.Digest = ctx.ImageDigest
+	info.LocalDigest = ctx.LocalDigest
+	if manifest, err := loadOciManifest(ctx.OciLayoutPath); err == nil {
+		info.ConfigDigest = manifest.Config.Digest
+		for _, layer := range manifest.Layers {
+			info.Layers = append(info.Layers, layer.Digest)
+		}
+		if config, _, err := loadOciConfig(ctx.OciLayoutPath); err == nil && config.OS != "" {
+			info.Platform = config.OS + "/" + config.Architecture
+			if config.Variant != "" {
+				info.Platform += "/" + config.Variant
+			}
+		}
+	}
+	return info
+}
+
+// buildTime is the timestamp recorded in provenance. SOURCE_DATE_EPOCH
+// overrides the clock so rebuilds can be byte-for-byte reproducible.
+func buildTime(ctx *ConversionContext) time.Time {
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		return time.Unix(epoch, 0).UTC()
+	}
+	return ctx.StartTime.UTC()
+}
+
+// writeBuildInfo embeds the build record at /etc/fsify/build.json.
+func writeBuildInfo(ctx *ConversionContext) error {
+	ctx.BuildInfo = newBuildInfo(ctx)
+	data, err := json.MarshalIndent(ctx.BuildInfo, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode build info: %w", err)
+	}
+	return writeRootfsFile(ctx, buildInfoPath, append(data, '\n'), 0644)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestBuildInfoKeepsDaemonDigestApart(t *testing.T) {
+	layout := writeOciLayout(t, []*tar.Header{{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}})
+	index, err := loadOciIndex(layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ConversionContext{ImageRef: "app:dev", OciLayoutPath: layout, LocalDigest: index.Manifests[0].Digest}
+
+	info := newBuildInfo(ctx)
+	if info.Digest != "" {
+		t.Errorf("digest = %q, want none for a docker-daemon source", info.Digest)
+	}
+	if info.LocalDigest != ctx.LocalDigest {
+		t.Errorf("localDigest = %q, want %q", info.LocalDigest, ctx.LocalDigest)
+	}
+	if got := ctx.sourceDigest(); got != ctx.LocalDigest {
+		t.Errorf("sourceDigest = %q, want the local digest", got)
+	}
+}
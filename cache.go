@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// blobCache keeps layer and config blobs between conversions, laid out like
+// an OCI layout's blobs directory: <dir>/blobs/sha256/<hex>. A blob's mtime
+// is the last time a conversion used it, which is what prune goes by.
+type blobCache struct {
+	dir string
+}
+
+// defaultCacheDir is $FSIFY_CACHE_DIR, or fsify under the user cache directory.
+func defaultCacheDir() string {
+	if dir := os.Getenv("FSIFY_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "fsify")
+	}
+	return filepath.Join(os.TempDir(), "fsify-cache")
+}
+
+func (c *blobCache) blobDir() string {
+	return filepath.Join(c.dir, "blobs", "sha256")
+}
+
+func (c *blobCache) blobPath(digest string) (string, bool) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || !digestPattern.MatchString(digest) {
+		return "", false
+	}
+	return filepath.Join(c.blobDir(), hexDigest), true
+}
+
+// seed places the cached blobs of an image into the OCI layout before it is
+// pulled, so skopeo only downloads the blobs that are missing. Each blob is
+// hashed first; one that does not match its digest is dropped and pulled.
+func (c *blobCache) seed(ctx *ConversionContext, ref string) error {
+	manifest, err := remoteManifest(ctx, ref)
+	if err != nil {
+		return err
+	}
+	layoutBlobs := filepath.Join(ctx.OciLayoutPath, "blobs", "sha256")
+	if err := os.MkdirAll(layoutBlobs, 0755); err != nil {
+		return fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+
+	var hits int
+	var saved int64
+	now := time.Now()
+	for _, desc := range append([]OCDescriptor{manifest.Config}, manifest.Layers...) {
+		src, ok := c.blobPath(desc.Digest)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(src)
+		if err != nil || info.Size() != desc.Size {
+			continue
+		}
+		// skopeo and openLayer trust blobs already in the layout, so a
+		// damaged or tampered cache entry must never get there
+		if sum, err := sha256File(src); err != nil || "sha256:"+sum != desc.Digest {
+			os.Remove(src)
+			if ctx.Verbose {
+				fmt.Printf("%s Layer cache: dropped %s, it does not match its digest\n", colorize("│", "yellow", ctx.NoColor), desc.Digest)
+			}
+			continue
+		}
+		if err := linkOrCopy(src, filepath.Join(layoutBlobs, filepath.Base(src))); err != nil {
+			return err
+		}
+		os.Chtimes(src, now, now)
+		hits++
+		saved += desc.Size
+	}
+	if ctx.Verbose {
+		fmt.Printf("%s Layer cache: %d of %d blobs cached (%s)\n", colorize("│", "cyan", ctx.NoColor),
+			hits, len(manifest.Layers)+1, formatBytes(saved))
+	}
+	return nil
+}
+
+// store adds every blob of the pulled OCI layout to the cache. Blobs are
+// checked against their digest, so a damaged download is never cached.
+func (c *blobCache) store(ctx *ConversionContext) error {
+	layoutBlobs := filepath.Join(ctx.OciLayoutPath, "blobs", "sha256")
+	entries, err := os.ReadDir(layoutBlobs)
+	if err != nil {
+		return fmt.Errorf("failed to read OCI layout: %w", err)
+	}
+	if err := os.MkdirAll(c.blobDir(), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		dest, ok := c.blobPath("sha256:" + entry.Name())
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(dest); err == nil {
+			continue
+		}
+		src := filepath.Join(layoutBlobs, entry.Name())
+		sum, err := sha256File(src)
+		if err != nil {
+			return err
+		}
+		if sum != entry.Name() {
+			return fmt.Errorf("blob %s does not match its digest", entry.Name())
+		}
+		// Place the blob under a temporary name so readers never see a partial file
+		tmp := filepath.Join(c.blobDir(), fmt.Sprintf(".tmp-%s-%d", entry.Name(), time.Now().UnixNano()))
+		if err := linkOrCopy(src, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("failed to add blob to cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// linkOrCopy hard links src to dest, or copies it across filesystems.
+func linkOrCopy(src, dest string) error {
+	err := os.Link(src, dest)
+	if err == nil || errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if !errors.Is(err, unix.EXDEV) && !errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("failed to link %s: %w", src, err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	return out.Close()
+}
+
+// pullWithCache runs a skopeo pull of ref into the OCI layout, seeding it
+// from the cache beforehand and filling the cache afterwards. Cache
+// problems only cost a download; they never fail the conversion.
+func pullWithCache(ctx *ConversionContext, ref string, pull func() error) error {
+	if ctx.Cache != nil {
+		if err := ctx.Cache.seed(ctx, ref); err != nil && ctx.Verbose {
+			fmt.Printf("%s Layer cache not used: %v\n", colorize("│", "yellow", ctx.NoColor), err)
+		}
+	}
+	if err := pull(); err != nil {
+		return err
+	}
+	if ctx.Cache != nil {
+		if err := ctx.Cache.store(ctx); err != nil && ctx.Verbose {
+			fmt.Printf("%s Failed to update layer cache: %v\n", colorize("│", "yellow", ctx.NoColor), err)
+		}
+	}
+	return nil
+}
+
+// cachedBlob is one blob in the cache, for list and prune.
+type cachedBlob struct {
+	path    string
+	size    int64
+	lastUse time.Time
+}
+
+// blobs returns the cached blobs, least recently used first.
+func (c *blobCache) blobs() ([]cachedBlob, error) {
+	entries, err := os.ReadDir(c.blobDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %w", err)
+	}
+	var blobs []cachedBlob
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue // Blob still being added
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		blobs = append(blobs, cachedBlob{filepath.Join(c.blobDir(), entry.Name()), info.Size(), info.ModTime()})
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].lastUse.Before(blobs[j].lastUse) })
+	return blobs, nil
+}
+
+// prune removes blobs unused for longer than maxAge (if set), then the least
+// recently used ones until the cache is at most maxSize bytes (if set).
+func (c *blobCache) prune(maxSize int64, maxAge time.Duration) (int, int64, error) {
+	blobs, err := c.blobs()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, blob := range blobs {
+		total += blob.size
+	}
+
+	var removed int
+	var freed int64
+	cutoff := time.Now().Add(-maxAge)
+	for _, blob := range blobs {
+		expired := maxAge > 0 && blob.lastUse.Before(cutoff)
+		tooBig := maxSize >= 0 && total > maxSize
+		if !expired && !tooBig {
+			continue
+		}
+		if err := os.Remove(blob.path); err != nil {
+			return removed, freed, fmt.Errorf("failed to remove %s: %w", blob.path, err)
+		}
+		removed++
+		freed += blob.size
+		total -= blob.size
+	}
+	return removed, freed, nil
+}
+
+// runCache implements `fsify cache dir|list|prune|clean`.
+func runCache(args []string) int {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	cacheDir := fs.String("cache-dir", defaultCacheDir(), "Cache directory")
+	maxSize := fs.String("max-size", "", "prune: shrink the cache to at most this size, e.g. 10G")
+	olderThan := fs.Duration("older-than", 0, "prune: remove blobs unused for this long, e.g. 720h")
+	fs.BoolVar(&noColor, "no-color", false, "Disable colored output")
+	fs.Usage = func() {
+		fmt.Println(`USAGE:
+    fsify cache dir                  Print the cache directory
+    fsify cache list                 List cached blobs, least recently used first
+    fsify cache prune [--max-size SIZE] [--older-than DURATION]
+    fsify cache clean                Remove every cached blob
+OPTIONS:
+    --cache-dir DIR                  Cache directory (env: FSIFY_CACHE_DIR)`)
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+	cache := &blobCache{dir: *cacheDir}
+	fail := func(err error) int {
+		fmt.Fprintf(os.Stderr, "%s %v\n", colorize("❌ Error:", "red", noColor), err)
+		return 1
+	}
+
+	switch positional[0] {
+	case "dir":
+		fmt.Println(cache.dir)
+	case "list":
+		blobs, err := cache.blobs()
+		if err != nil {
+			return fail(err)
+		}
+		var total int64
+		for _, blob := range blobs {
+			fmt.Printf("sha256:%s  %10s  %s\n", filepath.Base(blob.path), formatBytes(blob.size), blob.lastUse.Format(time.DateTime))
+			total += blob.size
+		}
+		fmt.Printf("%d blobs, %s in %s\n", len(blobs), formatBytes(total), cache.dir)
+	case "prune", "clean":
+		limit := int64(-1)
+		if positional[0] == "clean" {
+			limit = 0
+		} else if *maxSize != "" {
+			size, err := parseSize(*maxSize)
+			if err != nil {
+				return fail(fmt.Errorf("invalid --max-size: %w", err))
+			}
+			limit = size
+		} else if *olderThan == 0 {
+			return fail(fmt.Errorf("prune needs --max-size or --older-than"))
+		}
+		removed, freed, err := cache.prune(limit, *olderThan)
+		if err != nil {
+			return fail(err)
+		}
+		fmt.Printf("%s Removed %d blobs, freed %s\n", colorize("🧹", "green", noColor), removed, formatBytes(freed))
+	default:
+		fs.Usage()
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestBlobCacheSeedDropsTamperedBlobs(t *testing.T) {
+	config := []byte(`{"architecture":"amd64","os":"linux"}`)
+	layer := []byte("layer tarball")
+	configDigest, layerDigest := sha256Digest(config), sha256Digest(layer)
+	fakeSkopeo(t, fmt.Sprintf(`{"schemaVersion":2,"config":{"digest":"%s","size":%d},"layers":[{"digest":"%s","size":%d}]}`,
+		configDigest, len(config), layerDigest, len(layer)))
+
+	cache := &blobCache{dir: t.TempDir()}
+	if err := os.MkdirAll(cache.blobDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The cached layer has the right size but different content
+	tampered := bytes.ToUpper(layer)
+	for digest, data := range map[string][]byte{configDigest: config, layerDigest: tampered} {
+		p, _ := cache.blobPath(digest)
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := &ConversionContext{ImageRef: "registry.example/app:1", OciLayoutPath: t.TempDir(), RegistryManifests: make(map[string][]byte), NoColor: true}
+	if err := cache.seed(ctx, ctx.ImageRef); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ociBlobPath(ctx.OciLayoutPath, configDigest)); err != nil {
+		t.Errorf("intact config blob was not seeded: %v", err)
+	}
+	if _, err := os.Stat(ociBlobPath(ctx.OciLayoutPath, layerDigest)); err == nil {
+		t.Errorf("tampered layer blob was seeded into the OCI layout")
+	}
+	if p, _ := cache.blobPath(layerDigest); fileExists(p) {
+		t.Errorf("tampered layer blob was left in the cache")
+	}
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is one `fsify <name>` subcommand.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands = []command{
+	{"convert", "Convert an image to a filesystem image (default)", runConvert},
+	{"inspect", "Show what a built image contains", runInspect},
+	{"verify", "Check an image against its file manifest", runVerify},
+	{"build", "Build every image in a spec file", runBuild},
+	{"cache", "Show or prune the layer cache", runCache},
+	{"version", "Show version information", runVersion},
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// runCLI dispatches to a subcommand. Anything that is not a command name is
+// handed to convert, so `fsify nginx:latest` keeps working.
+func runCLI(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "help":
+			showUsage()
+			return 0
+		case "--version":
+			return runVersion(nil)
+		}
+		for _, cmd := range commands {
+			if args[0] == cmd.name {
+				return cmd.run(args[1:])
+			}
+		}
+	}
+	return runConvert(args)
+}
+
+// runVersion implements `fsify version`.
+func runVersion(args []string) int {
+	fmt.Printf("fsify version %s (built %s)\n", Version, BuildDate)
+	return 0
+}
+
+// parseArgs parses fs and returns the positional arguments. Unlike
+// fs.Parse, flags may follow positional arguments; everything after "--"
+// is positional.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		rest := fs.Args()
+		// fs.Parse drops the terminator, so look for it in what it consumed
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...)
+		}
+		if len(rest) == 0 {
+			return positional
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// aliasFlag registers alias as another name for an already defined flag.
+func aliasFlag(fs *flag.FlagSet, name, alias string) {
+	fs.Var(fs.Lookup(name).Value, alias, "Alias for --"+name)
+}
+
+// envName is the environment variable for a flag, e.g. FSIFY_CACHE_DIR for
+// --cache-dir.
+func envName(flagName string) string {
+	return "FSIFY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every long flag of fs from its FSIFY_* environment variable,
+// if set. Flags given on the command line are parsed afterwards and win; for
+// a list flag the command line values replace the environment's.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fromEnv := make(map[*stringList]*envList)
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || len(f.Name) < 2 || f.Name == "help" || f.Name == "version" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid %s=%q: %w", envName(f.Name), value, setErr)
+			return
+		}
+		if list, ok := f.Value.(*stringList); ok {
+			fromEnv[list] = &envList{stringList: list, fromEnv: true}
+		}
+	})
+	// Aliases share the list, so they reset it too
+	fs.VisitAll(func(f *flag.Flag) {
+		if list, ok := f.Value.(*stringList); ok && fromEnv[list] != nil {
+			f.Value = fromEnv[list]
+		}
+	})
+	return err
+}
+
+// envList is a list flag preset from the environment. The first value from
+// the command line clears the preset instead of adding to it.
+type envList struct {
+	*stringList
+	fromEnv bool
+}
+
+func (l *envList) Set(v string) error {
+	if l.fromEnv {
+		*l.stringList = nil
+		l.fromEnv = false
+	}
+	return l.stringList.Set(v)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"slices"
+	"testing"
+)
+
+func TestApplyEnvListFlags(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		args []string
+		want stringList
+	}{
+		{"environment only", nil, stringList{"/var/cache"}},
+		{"command line replaces", []string{"--exclude", "/tmp", "--exclude", "/srv"}, stringList{"/tmp", "/srv"}},
+		{"alias replaces", []string{"-x", "/tmp"}, stringList{"/tmp"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FSIFY_EXCLUDE", "/var/cache")
+			var exclude stringList
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Var(&exclude, "exclude", "")
+			aliasFlag(fs, "exclude", "x")
+			if err := applyEnv(fs); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(exclude, tt.want) {
+				t.Errorf("got %q, want %q", exclude, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cloudInitSuffix is appended to the primary output path for the NoCloud seed.
+const cloudInitSuffix = ".cidata.img"
+
+// cloudInitConfig are the files for the NoCloud seed.
+type cloudInitConfig struct {
+	UserData      string
+	MetaData      string // Optional; an instance-id is added if missing
+	NetworkConfig string // Optional
+}
+
+// seedFile is one file in the root directory of the seed volume.
+type seedFile struct {
+	name      string // Long name, e.g. "user-data"
+	shortName string // 8.3 name, space padded to 11 bytes
+	data      []byte
+}
+
+// buildCloudInitSeed writes the NoCloud seed: a FAT12 volume labelled CIDATA
+// holding user-data, meta-data and optionally network-config. cloud-init
+// finds it by label when it is attached as a second disk.
+func buildCloudInitSeed(ctx *ConversionContext) error {
+	userData, err := os.ReadFile(ctx.CloudInit.UserData)
+	if err != nil {
+		return fmt.Errorf("failed to read user-data: %w", err)
+	}
+	if bytes.HasPrefix(userData, []byte("#cloud-config")) {
+		var doc any
+		if err := yaml.Unmarshal(userData, &doc); err != nil {
+			return fmt.Errorf("user-data %s is not valid YAML: %w", ctx.CloudInit.UserData, err)
+		}
+	}
+
+	metaData, err := cloudInitMetaData(ctx)
+	if err != nil {
+		return err
+	}
+	files := []seedFile{
+		{"meta-data", "META-D~1   ", metaData},
+		{"user-data", "USER-D~1   ", userData},
+	}
+	if ctx.CloudInit.NetworkConfig != "" {
+		data, err := os.ReadFile(ctx.CloudInit.NetworkConfig)
+		if err != nil {
+			return fmt.Errorf("failed to read network-config: %w", err)
+		}
+		files = append(files, seedFile{"network-config", "NETWOR~1   ", data})
+	}
+
+	// A stable volume serial keeps rebuilt seeds byte-for-byte identical
+	var serial uint32
+	if digest := strings.TrimPrefix(ctx.sourceDigest(), "sha256:"); len(digest) >= 8 {
+		fmt.Sscanf(digest[:8], "%08x", &serial)
+	}
+	image, err := fat12Image("CIDATA", serial, buildTime(ctx), files)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(ctx.CloudInitPath, image, 0644); err != nil {
+		return fmt.Errorf("failed to write cloud-init seed: %w", err)
+	}
+	if ctx.Verbose {
+		fmt.Printf("%s Cloud-init seed: %d files, %s\n", colorize("│", "blue", ctx.NoColor), len(files), formatBytes(int64(len(image))))
+	}
+	return nil
+}
+
+// cloudInitMetaData returns --meta-data, or an empty document, with an
+// instance-id derived from the image digest unless one is set. cloud-init
+// runs its first-boot modules once per instance-id, so a new image digest
+// means the seed is applied again.
+func cloudInitMetaData(ctx *ConversionContext) ([]byte, error) {
+	meta := map[string]any{}
+	if ctx.CloudInit.MetaData != "" {
+		data, err := os.ReadFile(ctx.CloudInit.MetaData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read meta-data: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("meta-data %s is not a YAML mapping: %w", ctx.CloudInit.MetaData, err)
+		}
+		if meta == nil {
+			meta = map[string]any{}
+		}
+	}
+	if _, ok := meta["instance-id"]; !ok {
+		id := strings.TrimPrefix(ctx.sourceDigest(), "sha256:")
+		if len(id) > 16 {
+			id = id[:16]
+		}
+		meta["instance-id"] = "fsify-" + id
+	}
+	if _, ok := meta["local-hostname"]; !ok && ctx.Guest != nil && ctx.Guest.Hostname != "" {
+		meta["local-hostname"] = ctx.Guest.Hostname
+	}
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode meta-data: %w", err)
+	}
+	return data, nil
+}
+
+// FAT12 geometry for the seed volume
+const (
+	fatSectorSize  = 512
+	fatRootEntries = 64
+	fatMaxClusters = 4084 // More clusters would make it FAT16
+	fatMinClusters = 1024
+)
+
+// fat12Image builds a FAT12 volume with files in its root directory, using
+// VFAT long names so names like "user-data" survive.
+func fat12Image(label string, serial uint32, mtime time.Time, files []seedFile) ([]byte, error) {
+	// Pick the smallest cluster that keeps the volume FAT12
+	var spc, clusters int
+	for spc = 1; spc <= 64; spc *= 2 {
+		clusters = 0
+		for _, f := range files {
+			clusters += (len(f.data) + spc*fatSectorSize - 1) / (spc * fatSectorSize)
+		}
+		clusters = max(clusters, fatMinClusters/spc)
+		if clusters <= fatMaxClusters {
+			break
+		}
+	}
+	if spc > 64 {
+		return nil, fmt.Errorf("cloud-init files are too large for a seed volume")
+	}
+
+	fatSectors := ((clusters+2)*3/2 + fatSectorSize - 1) / fatSectorSize
+	rootSectors := fatRootEntries * 32 / fatSectorSize
+	dataStart := 1 + 2*fatSectors + rootSectors
+	totalSectors := dataStart + clusters*spc
+	image := make([]byte, totalSectors*fatSectorSize)
+
+	// Boot sector and BIOS parameter block
+	boot := image[:fatSectorSize]
+	copy(boot, []byte{0xEB, 0x3C, 0x90})
+	copy(boot[3:], "FSIFY   ")
+	binary.LittleEndian.PutUint16(boot[11:], fatSectorSize)
+	boot[13] = byte(spc)
+	binary.LittleEndian.PutUint16(boot[14:], 1) // Reserved sectors
+	boot[16] = 2                                // FAT copies
+	binary.LittleEndian.PutUint16(boot[17:], fatRootEntries)
+	binary.LittleEndian.PutUint16(boot[19:], uint16(totalSectors))
+	boot[21] = 0xF8 // Fixed disk
+	binary.LittleEndian.PutUint16(boot[22:], uint16(fatSectors))
+	binary.LittleEndian.PutUint16(boot[24:], 32) // Sectors per track
+	binary.LittleEndian.PutUint16(boot[26:], 64) // Heads
+	boot[36] = 0x80
+	boot[38] = 0x29 // Extended boot signature
+	binary.LittleEndian.PutUint32(boot[39:], serial)
+	copy(boot[43:54], fmt.Sprintf("%-11s", label))
+	copy(boot[54:62], "FAT12   ")
+	boot[510], boot[511] = 0x55, 0xAA
+
+	fat := make([]byte, fatSectors*fatSectorSize)
+	setFAT := func(cluster, value int) {
+		off := cluster * 3 / 2
+		if cluster%2 == 0 {
+			fat[off] = byte(value)
+			fat[off+1] = fat[off+1]&0xF0 | byte(value>>8)&0x0F
+		} else {
+			fat[off] = fat[off]&0x0F | byte(value<<4)
+			fat[off+1] = byte(value >> 4)
+		}
+	}
+	setFAT(0, 0xFF8)
+	setFAT(1, 0xFFF)
+
+	if mtime.Year() < 1980 {
+		mtime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	fatDate := uint16((mtime.Year()-1980)<<9 | int(mtime.Month())<<5 | mtime.Day())
+	fatTime := uint16(mtime.Hour()<<11 | mtime.Minute()<<5 | mtime.Second()/2)
+	dirEntry := func(name string, attr byte, cluster, size int) []byte {
+		e := make([]byte, 32)
+		copy(e, name)
+		e[11] = attr
+		for _, off := range []int{14, 22} {
+			binary.LittleEndian.PutUint16(e[off:], fatTime)
+			binary.LittleEndian.PutUint16(e[off+2:], fatDate)
+		}
+		binary.LittleEndian.PutUint16(e[18:], fatDate) // Last access
+		binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+		binary.LittleEndian.PutUint32(e[28:], uint32(size))
+		return e
+	}
+
+	root := image[(1+2*fatSectors)*fatSectorSize : dataStart*fatSectorSize]
+	entries := [][]byte{dirEntry(fmt.Sprintf("%-11s", label), 0x08, 0, 0)}
+	next := 2
+	for _, f := range files {
+		first := 0
+		n := (len(f.data) + spc*fatSectorSize - 1) / (spc * fatSectorSize)
+		if n > 0 {
+			first = next
+			for i := 0; i < n; i++ {
+				if i == n-1 {
+					setFAT(next+i, 0xFFF)
+				} else {
+					setFAT(next+i, next+i+1)
+				}
+			}
+			copy(image[(dataStart+(first-2)*spc)*fatSectorSize:], f.data)
+			next += n
+		}
+		entries = append(entries, longNameEntries(f.name, f.shortName)...)
+		entries = append(entries, dirEntry(f.shortName, 0x20, first, len(f.data)))
+	}
+	if len(entries) > fatRootEntries {
+		return nil, fmt.Errorf("too many files for the seed volume root directory")
+	}
+	for i, e := range entries {
+		copy(root[i*32:], e)
+	}
+
+	for i := 0; i < 2; i++ {
+		copy(image[(1+i*fatSectors)*fatSectorSize:], fat)
+	}
+	return image, nil
+}
+
+// longNameEntries returns the VFAT long name entries that precede the 8.3
+// entry for name, last part first as they are stored on disk.
+func longNameEntries(name, shortName string) [][]byte {
+	var sum byte
+	for i := 0; i < 11; i++ {
+		sum = (sum>>1 | sum<<7) + shortName[i]
+	}
+
+	units := utf16.Encode([]rune(name))
+	parts := (len(units) + 12) / 13
+	// Terminate with 0x0000 if there is room, then pad with 0xFFFF
+	padded := append(units, 0)
+	for len(padded) < parts*13 {
+		padded = append(padded, 0xFFFF)
+	}
+
+	var entries [][]byte
+	for part := parts; part >= 1; part-- {
+		e := make([]byte, 32)
+		e[0] = byte(part)
+		if part == parts {
+			e[0] |= 0x40
+		}
+		e[11] = 0x0F
+		e[13] = sum
+		chars := padded[(part-1)*13 : part*13]
+		for i, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(e[off:], chars[i])
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyJob is a single regular file queued for the copy workers.
+type copyJob struct {
+	src   string
+	dest  string
+	mode  fs.FileMode
+	size  int64
+	info  os.FileInfo // Source metadata, for ownership
+	entry int         // Index into the manifest, -1 when not recording one
+}
+
+// hardLink is a later path of a file with several links. It is linked to
+// the first copy once file data has been copied.
+type hardLink struct {
+	target string // Destination of the first path of the inode
+	dest   string
+	entry  int // Manifest index of this path, -1 when not recording one
+	first  int // Manifest index of the first path
+}
+
+// copyStats is updated concurrently by the copy workers.
+type copyStats struct {
+	bytes atomic.Int64 // Data bytes written (holes excluded)
+	files atomic.Int64
+	fast  atomic.Int64 // Files copied in-kernel with copy_file_range
+}
+
+func copyRootfsToImage(ctx *ConversionContext) error {
+	// Walk the actual rootfs subdirectory, not the unpacked parent
+	actualRootfs := filepath.Join(ctx.UnpackedPath, "rootfs")
+
+	// --- Step 1: Create the tree and collect regular files ---
+	// Directories, symlinks and special files are cheap and order-sensitive,
+	// so they are created during the walk; file data is copied afterwards.
+	var jobs []copyJob
+	var links []hardLink
+	var totalSize int64
+	type inodeKey struct{ dev, ino uint64 }
+	firstJob := make(map[inodeKey]int) // Index into jobs
+	var manifest []manifestEntry
+	recordManifest := ctx.ManifestPath != ""
+	err := filepath.WalkDir(actualRootfs, func(srcPath string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Get the relative path to reconstruct the destination
+		relPath, err := filepath.Rel(actualRootfs, srcPath)
+		if err != nil {
+			return err
+		}
+		destPath := filepath.Join(ctx.MountPoint, relPath)
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get info for %s: %w", srcPath, err)
+		}
+
+		entryIdx := -1
+		if recordManifest {
+			entry, ok, err := newManifestEntry(actualRootfs, srcPath, info)
+			if err != nil {
+				return fmt.Errorf("failed to record %s in manifest: %w", srcPath, err)
+			}
+			if ok {
+				entryIdx = len(manifest)
+				manifest = append(manifest, entry)
+			}
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if err := os.MkdirAll(destPath, 0755); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", srcPath, err)
+			}
+			if err := os.Symlink(target, destPath); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			// Hard links stay links, so their data is copied once
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				key := inodeKey{uint64(st.Dev), st.Ino}
+				if i, ok := firstJob[key]; ok {
+					links = append(links, hardLink{target: jobs[i].dest, dest: destPath, entry: entryIdx, first: jobs[i].entry})
+					return nil
+				}
+				firstJob[key] = len(jobs)
+			}
+			jobs = append(jobs, copyJob{src: srcPath, dest: destPath, mode: mode.Perm(), size: info.Size(), info: info, entry: entryIdx})
+			totalSize += info.Size()
+			return nil
+		case mode&os.ModeSocket != 0:
+			return nil
+		default:
+			if err := copySpecialFile(info, destPath); err != nil {
+				return err
+			}
+		}
+		return copyOwnership(info, destPath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk rootfs: %w", err)
+	}
+
+	// --- Step 2: Set up the progress bar ---
+	bar := newCopyProgressBar(ctx, totalSize, "Copying files to image")
+	var stats copyStats
+
+	// Workers only touch atomics; a single goroutine feeds the bar
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		ticker := time.NewTicker(65 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopProgress:
+				bar.Set64(stats.bytes.Load())
+				return
+			case <-ticker.C:
+				bar.Set64(stats.bytes.Load())
+			}
+		}
+	}()
+
+	// --- Step 3: Copy file data with a worker pool ---
+	workers := ctx.Jobs
+	if workers < 1 {
+		workers = 1
+	}
+	start := time.Now()
+
+	queue := make(chan copyJob)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   atomic.Bool
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if failed.Load() {
+					continue
+				}
+				err := copyFileSparse(job, &stats)
+				if err == nil {
+					err = copyOwnership(job.info, job.dest)
+				}
+				if err == nil && job.entry >= 0 {
+					// Hash the source so the manifest describes the rootfs, not the copy
+					manifest[job.entry].SHA256, err = sha256File(job.src)
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					failed.Store(true)
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		if failed.Load() {
+			break
+		}
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+
+	close(stopProgress)
+	<-progressDone
+	if firstErr != nil {
+		return firstErr
+	}
+	// Holes are never counted as copied bytes, so complete the bar explicitly
+	bar.Finish()
+
+	for _, link := range links {
+		if err := os.Link(link.target, link.dest); err != nil {
+			return fmt.Errorf("failed to create hard link %s: %w", link.dest, err)
+		}
+		if link.entry >= 0 && link.first >= 0 {
+			manifest[link.entry].SHA256 = manifest[link.first].SHA256
+		}
+	}
+
+	if ctx.Verbose {
+		elapsed := time.Since(start)
+		rate := float64(stats.bytes.Load()) / (1024 * 1024) / elapsed.Seconds()
+		fmt.Printf("\n%s Copied %d files (%d via copy_file_range, %d hard links) with %d workers in %s (%.1f MB/s)\n",
+			colorize("│", "blue", ctx.NoColor), stats.files.Load(), stats.fast.Load(), len(links), workers, elapsed.Round(time.Millisecond), rate)
+	}
+	if recordManifest {
+		return writeManifest(ctx, manifest)
+	}
+	return nil
+}
+
+// copyOwnership applies the source owner and full mode, including
+// setuid/setgid/sticky bits. chown clears setuid, so it runs first.
+func copyOwnership(info os.FileInfo, destPath string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if err := os.Lchown(destPath, int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %w", destPath, err)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	if err := unix.Chmod(destPath, st.Mode&07777); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", destPath, err)
+	}
+	return nil
+}
+
+// copySpecialFile recreates device nodes and FIFOs; sockets are skipped.
+func copySpecialFile(info os.FileInfo, destPath string) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeSocket != 0 {
+		return nil
+	}
+	if err := unix.Mknod(destPath, st.Mode, int(st.Rdev)); err != nil {
+		return fmt.Errorf("failed to create special file %s: %w", destPath, err)
+	}
+	return nil
+}
+
+// copyFileSparse copies only the data extents of src (found with
+// SEEK_DATA/SEEK_HOLE), preferring copy_file_range so the kernel can
+// reflink or copy without a round trip through user space. Holes are
+// recreated by leaving gaps and truncating the destination to full size.
+func copyFileSparse(job copyJob, stats *copyStats) error {
+	src, err := os.Open(job.src)
+	if err != nil {
+		return fmt.Errorf("failed to open source file %s: %w", job.src, err)
+	}
+	defer src.Close()
+
+	// Preserve file permissions
+	dest, err := os.OpenFile(job.dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, job.mode)
+	if err != nil {
+		return fmt.Errorf("failed to create destination file %s: %w", job.dest, err)
+	}
+
+	fast, err := copyDataExtents(src, dest, job.size, stats)
+	if err == nil {
+		err = dest.Truncate(job.size)
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", job.src, err)
+	}
+
+	stats.files.Add(1)
+	if fast {
+		stats.fast.Add(1)
+	}
+	return nil
+}
+
+// copyDataExtents copies every data extent of src into dest at the same
+// offset. It reports whether copy_file_range handled all of the data.
+func copyDataExtents(src, dest *os.File, size int64, stats *copyStats) (bool, error) {
+	srcFd := int(src.Fd())
+	useRange := true
+	var offset int64
+
+	for offset < size {
+		dataStart, err := unix.Seek(srcFd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			break // Only a hole remains
+		}
+		if err != nil {
+			// Filesystem without SEEK_DATA support: treat everything as data
+			dataStart = offset
+		}
+		dataEnd, err := unix.Seek(srcFd, dataStart, unix.SEEK_HOLE)
+		if err != nil || dataEnd > size {
+			dataEnd = size
+		}
+
+		if useRange {
+			n, err := copyRange(src, dest, dataStart, dataEnd, stats)
+			if err == nil {
+				offset = dataEnd
+				continue
+			}
+			if !errors.Is(err, unix.EXDEV) && !errors.Is(err, unix.ENOSYS) && !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.EOPNOTSUPP) {
+				return false, err
+			}
+			// Fall back to a buffered copy for the rest of the file
+			useRange = false
+			dataStart += n
+		}
+
+		reader := io.NewSectionReader(src, dataStart, dataEnd-dataStart)
+		writer := io.NewOffsetWriter(dest, dataStart)
+		if _, err := io.Copy(writer, &countingReader{r: reader, n: &stats.bytes}); err != nil {
+			return false, err
+		}
+		offset = dataEnd
+	}
+	return useRange, nil
+}
+
+// copyRange copies [start, end) with copy_file_range and returns how many
+// bytes were copied before any error.
+func copyRange(src, dest *os.File, start, end int64, stats *copyStats) (int64, error) {
+	var copied int64
+	for start+copied < end {
+		roff, woff := start+copied, start+copied
+		n, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dest.Fd()), &woff, int(end-start-copied), 0)
+		if err != nil {
+			return copied, err
+		}
+		if n == 0 {
+			return copied, io.ErrUnexpectedEOF
+		}
+		copied += int64(n)
+		stats.bytes.Add(int64(n))
+	}
+	return copied, nil
+}
+
+// countingReader adds every byte read to an atomic counter.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeRootfsTree generates an unpacked rootfs under dir/rootfs with many
+// small files, a few large sparse ones and a hard link.
+func makeRootfsTree(tb testing.TB, dir string, dirs, filesPerDir int) {
+	tb.Helper()
+	data := make([]byte, 16<<10)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	root := filepath.Join(dir, "rootfs")
+	for d := 0; d < dirs; d++ {
+		sub := filepath.Join(root, fmt.Sprintf("usr/lib/pkg%03d", d))
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		for f := 0; f < filesPerDir; f++ {
+			name := filepath.Join(sub, fmt.Sprintf("file%03d", f))
+			if f == 0 {
+				// 8 MiB with 4 KiB of data at each end
+				file, err := os.Create(name)
+				if err != nil {
+					tb.Fatal(err)
+				}
+				_, err = file.Write(data[:4096])
+				if err == nil {
+					_, err = file.WriteAt(data[:4096], 8<<20-4096)
+				}
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					tb.Fatal(err)
+				}
+				continue
+			}
+			if err := os.WriteFile(name, data[:1024+(f*997)%len(data[1024:])], 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+	if err := os.Link(filepath.Join(root, "usr/lib/pkg000/file001"), filepath.Join(root, "usr/lib/pkg000/file001.link")); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// copyTreeSequential is the baseline: one io.Copy per file, in walk order.
+func copyTreeSequential(src, dest string) error {
+	return filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+func BenchmarkCopyRootfs(b *testing.B) {
+	dir := b.TempDir()
+	makeRootfsTree(b, dir, 32, 64)
+
+	b.Run("io.Copy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dest := filepath.Join(b.TempDir(), "mnt")
+			if err := copyTreeSequential(filepath.Join(dir, "rootfs"), dest); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, jobs := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ctx := &ConversionContext{UnpackedPath: dir, MountPoint: b.TempDir(), Jobs: jobs, Quiet: true, NoColor: true}
+				if err := copyRootfsToImage(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyRootfsHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	makeRootfsTree(t, dir, 2, 4)
+	root := filepath.Join(dir, "rootfs")
+	if err := os.Link(filepath.Join(root, "usr/lib/pkg000/file001"), filepath.Join(root, "usr/lib/pkg001/other")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &ConversionContext{UnpackedPath: dir, MountPoint: t.TempDir(), Jobs: 4, Quiet: true, NoColor: true}
+	if err := copyRootfsToImage(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := os.Stat(filepath.Join(ctx.MountPoint, "usr/lib/pkg000/file001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"usr/lib/pkg000/file001.link", "usr/lib/pkg001/other"} {
+		info, err := os.Stat(filepath.Join(ctx.MountPoint, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(first, info) {
+			t.Errorf("/%s is a copy, not a hard link to /usr/lib/pkg000/file001", name)
+		}
+	}
+
+	sparse, err := os.Stat(filepath.Join(ctx.MountPoint, "usr/lib/pkg000/file000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sparse.Size() != 8<<20 {
+		t.Errorf("sparse file is %d bytes, want %d", sparse.Size(), 8<<20)
+	}
+}
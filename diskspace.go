@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// layerExpansionRatio is how much larger an unpacked layer is assumed to be
+// than its compressed blob. gzip and zstd layers typically unpack to 2-3x.
+const layerExpansionRatio = 3
+
+const tmpfsMagic = 0x01021994
+
+// imageManifest is the part of an OCI or Docker v2 image manifest fsify reads.
+type imageManifest struct {
+	Config OCDescriptor   `json:"config"`
+	Layers []OCDescriptor `json:"layers"`
+}
+
+// inspectRaw returns the raw manifest or index ref points to in the
+// registry. Responses are kept for the run, so the disk space check, the
+// digest resolution and the layer cache share one request per reference.
+func (ctx *ConversionContext) inspectRaw(ref string) ([]byte, error) {
+	if raw, ok := ctx.RegistryManifests[ref]; ok {
+		return raw, nil
+	}
+	raw, err := ctx.commandOutput("skopeo", "inspect", "--raw", "docker://"+ref)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.RegistryManifests != nil {
+		ctx.RegistryManifests[ref] = raw
+	}
+	return raw, nil
+}
+
+// remoteManifest fetches the image manifest for ref from the registry,
+// picking the host platform from a multi-arch index.
+func remoteManifest(ctx *ConversionContext, ref string) (*imageManifest, error) {
+	repo, _, _ := splitImageRef(ref)
+	raw, err := ctx.inspectRaw(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		imageManifest
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if len(doc.Manifests) > 0 {
+		digest := doc.Manifests[0].Digest
+		for _, m := range doc.Manifests {
+			if m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				digest = m.Digest
+				break
+			}
+		}
+		if raw, err = ctx.inspectRaw(fmt.Sprintf("%s@%s", repo, digest)); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		}
+	}
+	return &doc.imageManifest, nil
+}
+
+// remoteImageSize sums the compressed layer sizes from the registry
+// manifests of the image and any --overlay images.
+func remoteImageSize(ctx *ConversionContext) (int64, error) {
+	refs := []string{ctx.ImageRef}
+	for _, overlay := range ctx.Overlays {
+		refs = append(refs, overlay.Ref)
+	}
+	var total int64
+	for _, ref := range refs {
+		manifest, err := remoteManifest(ctx, ref)
+		if err != nil {
+			return 0, err
+		}
+		for _, layer := range manifest.Layers {
+			total += layer.Size
+		}
+	}
+	return total, nil
+}
+
+// diskSpace is the free space of the filesystem holding a directory.
+type diskSpace struct {
+	dir   string
+	dev   uint64
+	free  int64
+	tmpfs bool
+}
+
+// spaceUse is one thing the build writes to disk.
+type spaceUse struct {
+	what  string
+	bytes int64
+}
+
+// check fails with a breakdown if uses do not fit in the free space.
+func (d diskSpace) check(uses []spaceUse) error {
+	var total int64
+	var parts []string
+	for _, use := range uses {
+		total += use.bytes
+		parts = append(parts, fmt.Sprintf("%s %s", use.what, formatBytes(use.bytes)))
+	}
+	if total <= d.free {
+		return nil
+	}
+	where := d.dir
+	if d.tmpfs {
+		where += " (tmpfs)"
+	}
+	return fmt.Errorf("not enough space in %s: need about %s (%s), %s available; use --workdir or --output-dir to build elsewhere",
+		where, formatBytes(total), strings.Join(parts, ", "), formatBytes(d.free))
+}
+
+func statDiskSpace(dir string) (diskSpace, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return diskSpace{}, fmt.Errorf("failed to stat filesystem of %s: %w", dir, err)
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return diskSpace{}, fmt.Errorf("failed to stat %s: %w", dir, err)
+	}
+	return diskSpace{dir: dir, dev: st.Dev, free: int64(fs.Bavail) * fs.Bsize, tmpfs: fs.Type == tmpfsMagic}, nil
+}
+
+// checkDiskSpace estimates what the build will write to the work directory
+// and the output directory and fails before anything is downloaded if
+// either filesystem is too small.
+func checkDiskSpace(ctx *ConversionContext) error {
+	compressed, err := remoteImageSize(ctx)
+	if err != nil {
+		// Images only in the local daemon have no registry manifest to size
+		if !ctx.Quiet {
+			fmt.Fprintf(os.Stderr, "%s Warning: skipping the disk space check, image size unknown: %v\n", colorize("⚠️", "yellow", ctx.NoColor), err)
+		}
+		return nil
+	}
+	unpacked := compressed * layerExpansionRatio
+	image := unpacked + unpacked/10 + int64(ctx.BufferSize)<<20
+	if ctx.TargetSize > image {
+		image = ctx.TargetSize
+	}
+
+	work := []spaceUse{{"OCI layout", compressed}, {"image", image}}
+	if !ctx.Stream {
+		work = append(work, spaceUse{"unpacked rootfs", unpacked})
+	}
+	output := []spaceUse{{"image", image}}
+	if ctx.DualOutput {
+		work = append(work, spaceUse{"squashfs", unpacked / 2})
+		output = append(output, spaceUse{"squashfs", unpacked / 2})
+	}
+
+	workSpace, err := statDiskSpace(ctx.TempDir)
+	if err != nil {
+		return err
+	}
+	outputSpace, err := statDiskSpace(filepath.Dir(ctx.FinalPath))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Verbose {
+		fmt.Printf("%s Image layers are %s compressed, ~%s unpacked\n",
+			colorize("│", "blue", ctx.NoColor), formatBytes(compressed), formatBytes(unpacked))
+	}
+	if err := workSpace.check(work); err != nil {
+		return err
+	}
+	// On the same filesystem outputs are renamed into place and take no extra space
+	if outputSpace.dev != workSpace.dev {
+		return outputSpace.check(output)
+	}
+	return nil
+}
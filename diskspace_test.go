@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeSkopeo puts a skopeo on PATH that prints manifest for every inspect
+// and logs its arguments, one call per line, to the returned file.
+func fakeSkopeo(t *testing.T, manifest string) string {
+	t.Helper()
+	bin := t.TempDir()
+	calls := filepath.Join(bin, "calls")
+	skopeo := "#!/bin/sh\necho \"$@\" >> " + calls + "\necho '" + manifest + "'\n"
+	if err := os.WriteFile(filepath.Join(bin, "skopeo"), []byte(skopeo), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	return calls
+}
+
+func TestRegistryManifestFetchedOnce(t *testing.T) {
+	calls := fakeSkopeo(t, `{"schemaVersion":2,"layers":[{"digest":"sha256:aa","size":1000},{"digest":"sha256:bb","size":500}]}`)
+
+	ctx := &ConversionContext{ImageRef: "registry.example/app:1", RegistryManifests: make(map[string][]byte), NoColor: true}
+	size, err := remoteImageSize(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 1500 {
+		t.Errorf("remoteImageSize = %d, want 1500", size)
+	}
+	if _, err := resolveRegistryDigest(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteManifest(ctx, ctx.ImageRef); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 1 {
+		t.Errorf("skopeo ran %d times, want once:\n%s", n, data)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultBlockSize = 4096
+	ext4InodeSize    = 256
+	ext4GroupBlocks  = 32768 // Blocks per group at 4K blocks
+	xfsInodeSize     = 512
+	xfsMinSize       = 300 << 20 // mkfs.xfs refuses anything smaller
+	btrfsMinSize     = 128 << 20
+)
+
+// treeStats summarizes a rootfs in the units the filesystem estimators need.
+type treeStats struct {
+	Files       int64 // Regular files, hard links counted once
+	Dirs        int64
+	Symlinks    int64
+	Special     int64 // Devices and FIFOs
+	DataBlocks  int64 // Allocated data blocks at the estimator's block size
+	LongLinks   int64 // Symlinks too long to be stored inside the inode
+	XattrBlocks int64 // Files whose xattrs overflow the in-inode space
+	DirBlocks   int64
+	BigFiles    int64 // Files large enough to need extent index blocks
+}
+
+// sizeEstimate is the up-front size and inode count for the primary image.
+type sizeEstimate struct {
+	BlockSize     int64
+	DataBytes     int64
+	MetadataBytes int64
+	JournalBytes  int64
+	Inodes        int64
+	TotalBytes    int64
+}
+
+// dirEntrySize is the on-disk size of an ext4 directory entry for name.
+func dirEntrySize(name string) int64 {
+	return (8 + int64(len(name)) + 3) &^ 3
+}
+
+// blocksFor rounds n bytes up to whole blocks.
+func blocksFor(n, blockSize int64) int64 {
+	return (n + blockSize - 1) / blockSize
+}
+
+// collectTreeStats walks an unpacked rootfs and gathers treeStats.
+func collectTreeStats(root string, blockSize int64) (*treeStats, error) {
+	type inodeKey struct{ dev, ino uint64 }
+	seen := make(map[inodeKey]bool)
+	dirBytes := make(map[string]int64)
+	stats := &treeStats{}
+
+	err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if p != root {
+			dirBytes[filepath.Dir(p)] += dirEntrySize(d.Name())
+		}
+
+		// The copier links later paths of an inode to the first copy, so
+		// only the first path seen in walk order takes an inode and data
+		st, _ := info.Sys().(*syscall.Stat_t)
+		if st != nil && st.Nlink > 1 && !info.IsDir() {
+			key := inodeKey{uint64(st.Dev), st.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			stats.Dirs++
+			dirBytes[p] += dirEntrySize(".") + dirEntrySize("..")
+		case mode&os.ModeSymlink != 0:
+			stats.Symlinks++
+			if info.Size() >= 60 {
+				stats.LongLinks++
+			}
+		case mode.IsRegular():
+			stats.Files++
+			allocated := info.Size()
+			if st != nil {
+				allocated = st.Blocks * 512
+			}
+			stats.DataBlocks += blocksFor(allocated, blockSize)
+			if info.Size() > 512<<20 {
+				stats.BigFiles++
+			}
+		case mode&os.ModeSocket != 0:
+			return nil // Not copied
+		default:
+			stats.Special++
+		}
+
+		if xattrOverflows(p) {
+			stats.XattrBlocks++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range dirBytes {
+		stats.DirBlocks += max(1, blocksFor(n, blockSize))
+	}
+	return stats, nil
+}
+
+// xattrOverflows reports whether a file's xattrs won't fit in the spare
+// space of a 256-byte inode and so need their own block.
+func xattrOverflows(p string) bool {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		return false
+	}
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(p, names)
+	if err != nil {
+		return false
+	}
+
+	var total int
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			continue
+		}
+		total += 16 + len(name) + valueSize
+	}
+	return total > 100
+}
+
+// collectMergedStats gathers treeStats from merged layer headers in stream mode.
+func collectMergedStats(tree *mergedTree, blockSize int64) *treeStats {
+	stats := &treeStats{}
+	dirBytes := map[string]int64{"": dirEntrySize(".") + dirEntrySize("..")}
+
+	for name, entry := range tree.Entries {
+		hdr := entry.Header
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		dirBytes[parent] += dirEntrySize(path.Base(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			stats.Dirs++
+			dirBytes[name] += dirEntrySize(".") + dirEntrySize("..")
+		case tar.TypeSymlink:
+			stats.Symlinks++
+			if len(hdr.Linkname) >= 60 {
+				stats.LongLinks++
+			}
+		case tar.TypeReg:
+			stats.Files++
+			stats.DataBlocks += blocksFor(hdr.Size, blockSize)
+			if hdr.Size > 512<<20 {
+				stats.BigFiles++
+			}
+		case tar.TypeLink:
+			// Shares the target's inode
+		default:
+			stats.Special++
+		}
+
+		var xattrBytes int
+		for key, value := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "SCHILY.xattr.") {
+				xattrBytes += 16 + len(key) - len("SCHILY.xattr.") + len(value)
+			}
+		}
+		if xattrBytes > 100 {
+			stats.XattrBlocks++
+		}
+	}
+
+	// A hard link whose target is gone is written as the file itself
+	if _, promoted, err := tree.hardLinks(); err == nil {
+		for source := range promoted {
+			stats.Files++
+			stats.DataBlocks += blocksFor(source.Header.Size, blockSize)
+		}
+	}
+	for _, file := range tree.Extra {
+		stats.Files++
+		stats.DataBlocks += blocksFor(int64(len(file.Data)), blockSize)
+	}
+	stats.Dirs++ // Root directory
+	for _, n := range dirBytes {
+		stats.DirBlocks += max(1, blocksFor(n, blockSize))
+	}
+	return stats
+}
+
+// ext4JournalBlocks mirrors ext2fs_default_journal_size() from e2fsprogs.
+func ext4JournalBlocks(fsBlocks int64) int64 {
+	switch {
+	case fsBlocks < 2048:
+		return 0
+	case fsBlocks < 32768:
+		return 1024
+	case fsBlocks < 256*1024:
+		return 4096
+	case fsBlocks < 512*1024:
+		return 8192
+	case fsBlocks < 4096*1024:
+		return 16384
+	case fsBlocks < 8192*1024:
+		return 32768
+	case fsBlocks < 16384*1024:
+		return 65536
+	case fsBlocks < 32768*1024:
+		return 131072
+	default:
+		return 262144
+	}
+}
+
+// estimateFilesystemSize computes the image size and inode count needed to
+// hold a tree with the given stats on fsType, before any user buffer.
+func estimateFilesystemSize(stats *treeStats, fsType string, opts *fsOptions) *sizeEstimate {
+	blockSize := opts.blockSize()
+	est := &sizeEstimate{BlockSize: blockSize}
+	inodes := stats.Files + stats.Dirs + stats.Symlinks + stats.Special
+	est.DataBytes = stats.DataBlocks * blockSize
+
+	switch fsType {
+	case "xfs":
+		// Inodes are allocated dynamically in chunks of 64
+		est.Inodes = (inodes + 63) / 64 * 64
+		inodeSize := int64(xfsInodeSize)
+		if opts.InodeSize != 0 {
+			inodeSize = int64(opts.InodeSize)
+		}
+		est.MetadataBytes = est.Inodes*inodeSize + (stats.DirBlocks+stats.LongLinks+stats.XattrBlocks)*blockSize
+		est.MetadataBytes += est.DataBytes / 100 // Free space btrees and AG headers
+		est.JournalBytes = 64 << 20
+		est.TotalBytes = max(xfsMinSize, est.DataBytes+est.MetadataBytes+est.JournalBytes)
+	case "btrfs":
+		// Metadata is duplicated by default; roughly 1 KB of items per inode
+		est.Inodes = inodes
+		est.MetadataBytes = 2 * (inodes*1024 + stats.DirBlocks*blockSize)
+		est.TotalBytes = max(btrfsMinSize, est.DataBytes+est.MetadataBytes+est.DataBytes/50)
+	default:
+		// ext2/3/4: 11 reserved inodes plus 10% headroom for files created at boot
+		est.Inodes = (inodes + 11) * 11 / 10
+		if est.Inodes < 1024 {
+			est.Inodes = 1024
+		}
+		blocks := stats.DataBlocks + stats.DirBlocks + stats.LongLinks + stats.XattrBlocks + stats.BigFiles*2
+		inodeSize := int64(ext4InodeSize)
+		if opts.InodeSize != 0 {
+			inodeSize = int64(opts.InodeSize)
+		}
+		inodeTableBlocks := blocksFor(est.Inodes*inodeSize, blockSize)
+		groups := blocksFor(blocks+inodeTableBlocks, ext4GroupBlocks*defaultBlockSize/blockSize)
+		// Per group: block and inode bitmaps, plus descriptors and reserved GDT blocks
+		metadataBlocks := inodeTableBlocks + groups*2 + 256 + blocksFor(groups*64, blockSize)
+		est.MetadataBytes = (stats.DirBlocks + stats.LongLinks + stats.XattrBlocks + stats.BigFiles*2 + metadataBlocks) * blockSize
+		if !opts.Ext4.NoJournal {
+			est.JournalBytes = ext4JournalBlocks(blocks+metadataBlocks) * blockSize
+		}
+		est.TotalBytes = est.DataBytes + est.MetadataBytes + est.JournalBytes
+		// resize2fs -M and e2fsck need some slack to work with
+		est.TotalBytes += est.TotalBytes / 50
+	}
+
+	est.TotalBytes = blocksFor(est.TotalBytes, blockSize) * blockSize
+	return est
+}
+
+// estimateImageSize gathers tree statistics for the current mode and
+// stores the resulting estimate on the context.
+func estimateImageSize(ctx *ConversionContext) (*sizeEstimate, error) {
+	blockSize := ctx.FsOptions.blockSize()
+
+	var stats *treeStats
+	if ctx.Merged != nil {
+		stats = collectMergedStats(ctx.Merged, blockSize)
+	} else {
+		var err error
+		stats, err = collectTreeStats(filepath.Join(ctx.UnpackedPath, "rootfs"), blockSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan rootfs: %w", err)
+		}
+	}
+
+	est := estimateFilesystemSize(stats, ctx.FsType, &ctx.FsOptions)
+	if ctx.Verbose {
+		fmt.Printf("%s Tree: %d files, %d dirs, %d symlinks, %d special, %d data blocks\n",
+			colorize("│", "blue", ctx.NoColor), stats.Files, stats.Dirs, stats.Symlinks, stats.Special, stats.DataBlocks)
+		fmt.Printf("%s Estimate (%s): data %s, metadata %s, journal %s, %d inodes\n",
+			colorize("│", "blue", ctx.NoColor), ctx.FsType, formatBytes(est.DataBytes), formatBytes(est.MetadataBytes), formatBytes(est.JournalBytes), est.Inodes)
+	}
+	ctx.Estimate = est
+	return est, nil
+}
+
+// formatBytes renders a byte count in MB for progress output.
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%.2f MB", float64(n)/(1024*1024))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// pendingStaged maps staging files that are not placed yet to the work
+// files they came from, so the interrupt handler can take them back out
+// of the output directories.
+var pendingStaged = struct {
+	sync.Mutex
+	files map[string]string
+}{files: make(map[string]string)}
+
+func trackStaged(stagingPath, src string) {
+	pendingStaged.Lock()
+	pendingStaged.files[stagingPath] = src
+	pendingStaged.Unlock()
+}
+
+func forgetStaged(stagingPath string) {
+	pendingStaged.Lock()
+	delete(pendingStaged.files, stagingPath)
+	pendingStaged.Unlock()
+}
+
+// unstagePending undoes every staging file not placed yet. The interrupt
+// handler runs it before removing the work directory.
+func unstagePending() {
+	pendingStaged.Lock()
+	files := pendingStaged.files
+	pendingStaged.files = make(map[string]string)
+	pendingStaged.Unlock()
+	for stagingPath, src := range files {
+		unstageFile(stagingPath, src)
+	}
+}
+
+// finalOutput is a finished file in the work directory and where it goes.
+type finalOutput struct {
+	label string
+	src   string
+	dest  string
+}
+
+// finalOutputs lists everything a conversion produces, primary image first.
+func (ctx *ConversionContext) finalOutputs() []finalOutput {
+	outputs := []finalOutput{{"image", ctx.ImagePath, ctx.FinalPath}}
+	if ctx.DualOutput {
+		outputs = append(outputs, finalOutput{"squashfs image", ctx.SquashfsPath, ctx.FinalSquashfsPath})
+	}
+	if ctx.SBOMPath != "" {
+		outputs = append(outputs, finalOutput{"SBOM", ctx.SBOMPath, ctx.FinalSBOMPath})
+	}
+	if ctx.ManifestPath != "" {
+		outputs = append(outputs, finalOutput{"manifest", ctx.ManifestPath, ctx.FinalManifestPath})
+	}
+	if ctx.CloudInitPath != "" {
+		outputs = append(outputs, finalOutput{"cloud-init seed", ctx.CloudInitPath, ctx.FinalCloudInitPath})
+	}
+	return append(outputs, finalOutput{"provenance", ctx.ProvenancePath, ctx.FinalProvenancePath})
+}
+
+// checkOutputsFree fails if any output would replace an existing file.
+func checkOutputsFree(outputs []finalOutput, force bool) error {
+	if force {
+		return nil
+	}
+	for _, out := range outputs {
+		if _, err := os.Lstat(out.dest); err == nil {
+			return fmt.Errorf("%s already exists (use --force to overwrite)", out.dest)
+		}
+	}
+	return nil
+}
+
+// finalizeOutputs moves every output into place in two steps. Each output
+// is first staged next to its destination, copying across filesystems if
+// needed; only once all are staged are they renamed into place. A failure
+// while staging places nothing. A failure while placing keeps the outputs
+// already placed and reports the ones that are missing.
+func finalizeOutputs(ctx *ConversionContext) error {
+	outputs := ctx.finalOutputs()
+	staged := make([]string, 0, len(outputs))
+	for _, out := range outputs {
+		path, err := stageFile(out.src, out.dest)
+		if err != nil {
+			for i, path := range staged {
+				unstageFile(path, outputs[i].src)
+			}
+			return fmt.Errorf("failed to stage %s at %s: %w", out.label, out.dest, err)
+		}
+		staged = append(staged, path)
+	}
+
+	dirs := make(map[string]bool)
+	for i, out := range outputs {
+		if err := placeFile(staged[i], out.dest, ctx.Force); err != nil {
+			var missing []string
+			for j := i; j < len(outputs); j++ {
+				unstageFile(staged[j], outputs[j].src)
+				missing = append(missing, outputs[j].dest)
+			}
+			return fmt.Errorf("failed to move %s to %s: %w (not placed: %s)", out.label, out.dest, err, strings.Join(missing, ", "))
+		}
+		forgetStaged(staged[i])
+		// Cross-filesystem sources were copied, not renamed
+		os.Remove(out.src)
+		dirs[filepath.Dir(out.dest)] = true
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// stageFile moves src to a staging file next to dest and returns its path.
+// Within a filesystem this is a rename. Across filesystems the data is
+// copied sparsely and synced, and src is kept until the output is placed.
+func stageFile(src, dest string) (string, error) {
+	staging, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".partial-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging file: %w", err)
+	}
+	stagingPath := staging.Name()
+	staging.Close()
+	trackStaged(stagingPath, src)
+
+	err = os.Rename(src, stagingPath)
+	if err == nil {
+		return stagingPath, nil
+	}
+	if !errors.Is(err, unix.EXDEV) {
+		os.Remove(stagingPath)
+		forgetStaged(stagingPath)
+		return "", err
+	}
+	if err := copyToStaging(src, stagingPath); err != nil {
+		os.Remove(stagingPath)
+		forgetStaged(stagingPath)
+		return "", err
+	}
+	return stagingPath, nil
+}
+
+// copyToStaging copies src over the staging file with its mode and syncs it.
+func copyToStaging(src, stagingPath string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	var stats copyStats
+	if err := copyFileSparse(copyJob{src: src, dest: stagingPath, mode: info.Mode().Perm(), size: info.Size()}, &stats); err != nil {
+		return err
+	}
+	if err := os.Chmod(stagingPath, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := syncPath(stagingPath); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", stagingPath, err)
+	}
+	return nil
+}
+
+// unstageFile undoes stageFile: a renamed output goes back to src, a copy
+// is dropped since src still exists.
+func unstageFile(stagingPath, src string) {
+	defer forgetStaged(stagingPath)
+	if _, err := os.Lstat(src); err == nil {
+		os.Remove(stagingPath)
+		return
+	}
+	if err := os.Rename(stagingPath, src); err != nil {
+		os.Remove(stagingPath)
+	}
+}
+
+// placeFile atomically renames src to dest. Without overwrite it links
+// instead, which fails rather than replacing an existing dest.
+func placeFile(src, dest string, overwrite bool) error {
+	if overwrite {
+		return os.Rename(src, dest)
+	}
+	err := os.Link(src, dest)
+	switch {
+	case err == nil:
+		return os.Remove(src)
+	case errors.Is(err, os.ErrExist):
+		return fmt.Errorf("%s already exists (use --force to overwrite)", dest)
+	case errors.Is(err, unix.EPERM) || errors.Is(err, unix.EOPNOTSUPP):
+		// No hard links on this filesystem; check, then rename
+		if _, statErr := os.Lstat(dest); statErr == nil {
+			return fmt.Errorf("%s already exists (use --force to overwrite)", dest)
+		}
+		return os.Rename(src, dest)
+	}
+	return err
+}
+
+// syncPath fsyncs a file or directory.
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
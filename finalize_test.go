@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// finalizeContext returns a context with an image and provenance ready in
+// a work directory, to be placed in outDir.
+func finalizeContext(t *testing.T, outDir string) *ConversionContext {
+	t.Helper()
+	work := t.TempDir()
+	ctx := &ConversionContext{
+		ImagePath:           filepath.Join(work, "image.img"),
+		FinalPath:           filepath.Join(outDir, "app.img"),
+		ProvenancePath:      filepath.Join(work, "provenance.json"),
+		FinalProvenancePath: filepath.Join(outDir, "app.provenance.json"),
+	}
+	for _, path := range []string{ctx.ImagePath, ctx.ProvenancePath} {
+		if err := os.WriteFile(path, []byte(filepath.Base(path)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ctx
+}
+
+func readString(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFinalizeOutputs(t *testing.T) {
+	out := t.TempDir()
+	ctx := finalizeContext(t, out)
+	if err := finalizeOutputs(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, ctx.FinalPath); got != "image.img" {
+		t.Errorf("image holds %q", got)
+	}
+	if got := readString(t, ctx.FinalProvenancePath); got != "provenance.json" {
+		t.Errorf("provenance holds %q", got)
+	}
+	entries, _ := os.ReadDir(out)
+	if len(entries) != 2 {
+		t.Errorf("output directory has %d entries, want 2 with no staging files left", len(entries))
+	}
+}
+
+func TestFinalizeOutputsStagingFailurePlacesNothing(t *testing.T) {
+	out := t.TempDir()
+	ctx := finalizeContext(t, out)
+	// Provenance cannot be staged: its directory does not exist
+	ctx.FinalProvenancePath = filepath.Join(out, "missing", "app.provenance.json")
+
+	if err := finalizeOutputs(ctx); err == nil {
+		t.Fatal("expected a staging error")
+	}
+	entries, _ := os.ReadDir(out)
+	if len(entries) != 0 {
+		t.Errorf("output directory has %d entries, want none", len(entries))
+	}
+	if got := readString(t, ctx.ImagePath); got != "image.img" {
+		t.Errorf("image was not returned to the work directory, holds %q", got)
+	}
+}
+
+func TestFinalizeOutputsPlacingFailureKeepsPlaced(t *testing.T) {
+	out := t.TempDir()
+	ctx := finalizeContext(t, out)
+	// Appears after the preflight check, so placing the provenance fails
+	if err := os.WriteFile(ctx.FinalProvenancePath, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := finalizeOutputs(ctx)
+	if err == nil || !strings.Contains(err.Error(), "not placed: "+ctx.FinalProvenancePath) {
+		t.Fatalf("expected the provenance to be reported missing, got %v", err)
+	}
+	if got := readString(t, ctx.FinalPath); got != "image.img" {
+		t.Errorf("placed image was removed or changed, holds %q", got)
+	}
+	if got := readString(t, ctx.FinalProvenancePath); got != "existing" {
+		t.Errorf("existing provenance was replaced with %q", got)
+	}
+	if got := readString(t, ctx.ProvenancePath); got != "provenance.json" {
+		t.Errorf("provenance was not returned to the work directory, holds %q", got)
+	}
+	entries, _ := os.ReadDir(out)
+	if len(entries) != 2 {
+		t.Errorf("output directory has %d entries, want 2 with no staging files left", len(entries))
+	}
+}
+
+func TestUnstagePendingOnInterrupt(t *testing.T) {
+	out := t.TempDir()
+	ctx := finalizeContext(t, out)
+	// Staged but not placed, as when a signal arrives mid-finalize
+	if _, err := stageFile(ctx.ImagePath, ctx.FinalPath); err != nil {
+		t.Fatal(err)
+	}
+	unstagePending()
+
+	entries, _ := os.ReadDir(out)
+	if len(entries) != 0 {
+		t.Errorf("output directory has %d entries, want no staging files left", len(entries))
+	}
+	if got := readString(t, ctx.ImagePath); got != "image.img" {
+		t.Errorf("image was not returned to the work directory, holds %q", got)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fsOptions are the typed mkfs tuning options. Common options map to each
+// backend's own flag; backend-specific ones live in their own struct and
+// are rejected for other filesystems.
+type fsOptions struct {
+	Label      string       `json:"label,omitempty"`
+	UUID       string       `json:"uuid,omitempty"`
+	BlockSize  int          `json:"blockSize,omitempty"`  // Bytes, 0 for the mkfs default
+	InodeSize  int          `json:"inodeSize,omitempty"`  // Bytes, 0 for the mkfs default
+	InodeRatio int          `json:"inodeRatio,omitempty"` // Bytes per inode (ext4 only), 0 to size inodes from the tree
+	Ext4       ext4Options  `json:"ext4"`
+	XFS        xfsOptions   `json:"xfs"`
+	Btrfs      btrfsOptions `json:"btrfs"`
+}
+
+type ext4Options struct {
+	Features        []string `json:"features,omitempty"` // e.g. "metadata_csum", "^has_journal"
+	NoJournal       bool     `json:"noJournal,omitempty"`
+	ReservedPercent float64  `json:"reservedPercent"` // -1 for the mkfs default (5%)
+}
+
+type xfsOptions struct {
+	Reflink string `json:"reflink,omitempty"` // "on", "off" or "" for the mkfs default
+}
+
+type btrfsOptions struct {
+	Compress string `json:"compress,omitempty"` // e.g. "zstd", "zstd:3", "lzo", "zlib"
+}
+
+var (
+	uuidPattern     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	compressPattern = regexp.MustCompile(`^(zlib(:[1-9])?|lzo|zstd(:([1-9]|1[0-5]))?)$`)
+
+	// Features mke2fs accepts in -O for ext4
+	knownExt4Features = map[string]bool{
+		"64bit": true, "dir_index": true, "dir_nlink": true, "ea_inode": true, "encrypt": true,
+		"extent": true, "extents": true, "extra_isize": true, "filetype": true, "flex_bg": true,
+		"has_journal": true, "huge_file": true, "inline_data": true, "large_dir": true,
+		"large_file": true, "metadata_csum": true, "metadata_csum_seed": true, "mmp": true,
+		"orphan_file": true, "project": true, "quota": true, "resize_inode": true,
+		"sparse_super": true, "sparse_super2": true, "stable_inodes": true, "uninit_bg": true,
+		"verity": true, "casefold": true, "ext_attr": true,
+	}
+
+	// Label length limits per filesystem
+	labelLimits = map[string]int{"ext4": 16, "xfs": 12, "btrfs": 255, "erofs": 15}
+)
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+// blockSize returns the configured block size or the default.
+func (o *fsOptions) blockSize() int64 {
+	if o.BlockSize > 0 {
+		return int64(o.BlockSize)
+	}
+	return defaultBlockSize
+}
+
+// validate checks every option against what fsType supports.
+func (o *fsOptions) validate(fsType string) error {
+	if limit, ok := labelLimits[fsType]; ok && len(o.Label) > limit {
+		return fmt.Errorf("label %q is longer than %d characters allowed by %s", o.Label, limit, fsType)
+	}
+	if o.UUID != "" && !uuidPattern.MatchString(o.UUID) {
+		return fmt.Errorf("invalid UUID %q", o.UUID)
+	}
+
+	if o.BlockSize != 0 {
+		valid := isPowerOfTwo(o.BlockSize)
+		switch fsType {
+		case "ext4", "erofs":
+			valid = valid && o.BlockSize >= 1024 && o.BlockSize <= 65536
+		case "xfs":
+			valid = valid && o.BlockSize >= 512 && o.BlockSize <= 65536
+		case "btrfs":
+			valid = valid && o.BlockSize >= 4096 && o.BlockSize <= 65536
+		}
+		if !valid {
+			return fmt.Errorf("block size %d is not supported by %s", o.BlockSize, fsType)
+		}
+	}
+
+	if o.InodeSize != 0 {
+		switch fsType {
+		case "ext4":
+			if !isPowerOfTwo(o.InodeSize) || o.InodeSize < 128 || int64(o.InodeSize) > o.blockSize() {
+				return fmt.Errorf("ext4 inode size must be a power of two between 128 and the block size")
+			}
+		case "xfs":
+			if !isPowerOfTwo(o.InodeSize) || o.InodeSize < 256 || o.InodeSize > 2048 {
+				return fmt.Errorf("xfs inode size must be a power of two between 256 and 2048")
+			}
+		default:
+			return fmt.Errorf("--inode-size is not supported by %s", fsType)
+		}
+	}
+
+	if o.InodeRatio != 0 {
+		if fsType != "ext4" {
+			return fmt.Errorf("--inode-ratio is only supported by ext4")
+		}
+		if int64(o.InodeRatio) < o.blockSize() || o.InodeRatio > 64<<20 {
+			return fmt.Errorf("--inode-ratio must be between the block size and 64MB")
+		}
+	}
+
+	if p := o.Ext4.ReservedPercent; p != -1 && !(p >= 0 && p <= 50) {
+		return fmt.Errorf("--reserved-percent must be between 0 and 50")
+	}
+	if fsType != "ext4" && (len(o.Ext4.Features) > 0 || o.Ext4.NoJournal || o.Ext4.ReservedPercent != -1) {
+		return fmt.Errorf("--ext4-features, --no-journal and --reserved-percent are only supported by ext4")
+	}
+	for _, feature := range o.Ext4.Features {
+		if !knownExt4Features[strings.TrimPrefix(feature, "^")] {
+			return fmt.Errorf("unknown ext4 feature %q", feature)
+		}
+	}
+
+	if o.XFS.Reflink != "" {
+		if fsType != "xfs" {
+			return fmt.Errorf("--xfs-reflink is only supported by xfs")
+		}
+		if o.XFS.Reflink != "on" && o.XFS.Reflink != "off" {
+			return fmt.Errorf("--xfs-reflink must be on or off")
+		}
+	}
+
+	if o.Btrfs.Compress != "" {
+		if fsType != "btrfs" {
+			return fmt.Errorf("--btrfs-compress is only supported by btrfs")
+		}
+		if !compressPattern.MatchString(o.Btrfs.Compress) {
+			return fmt.Errorf("invalid btrfs compression %q (use zlib[:1-9], lzo or zstd[:1-15])", o.Btrfs.Compress)
+		}
+	}
+	return nil
+}
+
+// mkfsArgs translates the options into mkfs.<fsType> arguments.
+func (o *fsOptions) mkfsArgs(fsType string) []string {
+	var args []string
+	switch fsType {
+	case "ext4":
+		if o.Label != "" {
+			args = append(args, "-L", o.Label)
+		}
+		if o.UUID != "" {
+			args = append(args, "-U", o.UUID)
+		}
+		if o.BlockSize != 0 {
+			args = append(args, "-b", strconv.Itoa(o.BlockSize))
+		}
+		if o.InodeSize != 0 {
+			args = append(args, "-I", strconv.Itoa(o.InodeSize))
+		}
+		if o.InodeRatio != 0 {
+			args = append(args, "-i", strconv.Itoa(o.InodeRatio))
+		}
+		features := append([]string{}, o.Ext4.Features...)
+		if o.Ext4.NoJournal {
+			features = append(features, "^has_journal")
+		}
+		if len(features) > 0 {
+			args = append(args, "-O", strings.Join(features, ","))
+		}
+		if o.Ext4.ReservedPercent >= 0 {
+			args = append(args, "-m", strconv.FormatFloat(o.Ext4.ReservedPercent, 'f', -1, 64))
+		}
+	case "xfs":
+		if o.Label != "" {
+			args = append(args, "-L", o.Label)
+		}
+		if o.UUID != "" {
+			args = append(args, "-m", "uuid="+o.UUID)
+		}
+		if o.BlockSize != 0 {
+			args = append(args, "-b", "size="+strconv.Itoa(o.BlockSize))
+		}
+		if o.InodeSize != 0 {
+			args = append(args, "-i", "size="+strconv.Itoa(o.InodeSize))
+		}
+		switch o.XFS.Reflink {
+		case "on":
+			args = append(args, "-m", "reflink=1")
+		case "off":
+			args = append(args, "-m", "reflink=0")
+		}
+	case "btrfs":
+		if o.Label != "" {
+			args = append(args, "-L", o.Label)
+		}
+		if o.UUID != "" {
+			args = append(args, "-U", o.UUID)
+		}
+		if o.BlockSize != 0 {
+			args = append(args, "-s", strconv.Itoa(o.BlockSize))
+		}
+	case "erofs":
+		if o.Label != "" {
+			args = append(args, "-L", o.Label)
+		}
+		if o.UUID != "" {
+			args = append(args, "-U", o.UUID)
+		}
+		if o.BlockSize != 0 {
+			args = append(args, "-b", strconv.Itoa(o.BlockSize))
+		}
+	}
+	return args
+}
+
+// mountOptions returns extra mount options used while populating the image.
+func (o *fsOptions) mountOptions(fsType string) []string {
+	if fsType == "btrfs" && o.Btrfs.Compress != "" {
+		return []string{"-o", "compress=" + o.Btrfs.Compress}
+	}
+	return nil
+}
+
+// applyMountedDefaults persists options that live in the filesystem itself
+// rather than in mkfs, so they still apply when the image is booted.
+func applyMountedDefaults(ctx *ConversionContext) error {
+	if ctx.FsType == "btrfs" && ctx.FsOptions.Btrfs.Compress != "" {
+		// New files under / inherit the compression property
+		algo, _, _ := strings.Cut(ctx.FsOptions.Btrfs.Compress, ":")
+		return ctx.runCommand("btrfs", "property", "set", ctx.MountPoint, "compression", algo)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFsOptionsValidateReservedPercent(t *testing.T) {
+	for _, tt := range []struct {
+		percent float64
+		fsType  string
+		wantErr bool
+	}{
+		{-1, "ext4", false},
+		{-1, "xfs", false},
+		{0, "ext4", false},
+		{50, "ext4", false},
+		{50.5, "ext4", true},
+		{-5, "ext4", true},
+		{-0.5, "ext4", true},
+		{-5, "xfs", true},
+		{math.NaN(), "ext4", true},
+		{1, "xfs", true},
+	} {
+		o := fsOptions{Ext4: ext4Options{ReservedPercent: tt.percent}}
+		if err := o.validate(tt.fsType); (err != nil) != tt.wantErr {
+			t.Errorf("%s with --reserved-percent %v: got %v, want error %v", tt.fsType, tt.percent, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// hostnamePattern is an RFC 1123 host name: dot-separated labels of letters,
+// digits and inner hyphens.
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// guestConfig is the system configuration written so the image boots as a
+// VM: container runtimes provide these files at run time, a VM does not.
+type guestConfig struct {
+	Hostname string   `json:"hostname,omitempty"`
+	DNS      []string `json:"dns,omitempty"`
+	Fstab    string   `json:"fstab,omitempty"` // "auto" or empty
+	Tmpfs    []string `json:"tmpfs,omitempty"` // path[:options]
+}
+
+// newGuestConfig validates the guest options. With --fstab auto the root
+// entry refers to the filesystem by label, or by UUID; a UUID is generated
+// now if none was given, so mkfs and fstab agree.
+func newGuestConfig(opts convertOptions, fsOpts *fsOptions) (*guestConfig, error) {
+	g := &guestConfig{Hostname: opts.Hostname, DNS: opts.DNS, Fstab: opts.Fstab, Tmpfs: opts.Tmpfs}
+	if g.Hostname != "" && (len(g.Hostname) > 253 || !hostnamePattern.MatchString(g.Hostname)) {
+		return nil, fmt.Errorf("invalid --hostname %q", g.Hostname)
+	}
+	for _, server := range g.DNS {
+		if net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("invalid --dns %q: expected an IP address", server)
+		}
+	}
+	switch g.Fstab {
+	case "", "none":
+		g.Fstab = ""
+		if len(g.Tmpfs) > 0 {
+			return nil, fmt.Errorf("--tmpfs requires --fstab auto")
+		}
+	case "auto":
+		if fsOpts.Label == "" && fsOpts.UUID == "" {
+			fsOpts.UUID = newUUID()
+		}
+	default:
+		return nil, fmt.Errorf("invalid --fstab %q (use auto or none)", g.Fstab)
+	}
+	for _, mount := range g.Tmpfs {
+		if dir, _, _ := strings.Cut(mount, ":"); !strings.HasPrefix(dir, "/") || strings.ContainsAny(mount, " \t") {
+			return nil, fmt.Errorf("invalid --tmpfs %q: expected /path[:options]", mount)
+		}
+	}
+	if g.Hostname == "" && len(g.DNS) == 0 && g.Fstab == "" {
+		return nil, nil
+	}
+	return g, nil
+}
+
+// fstab renders /etc/fstab with the root filesystem and any tmpfs mounts.
+func (g *guestConfig) fstab(fsType string, fsOpts fsOptions) string {
+	source := "UUID=" + fsOpts.UUID
+	if fsOpts.Label != "" {
+		source = "LABEL=" + fsOpts.Label
+	}
+	options, pass := "defaults", "1"
+	switch fsType {
+	case "erofs":
+		options, pass = "ro", "0"
+	case "xfs", "btrfs":
+		// fsck.xfs and fsck.btrfs do nothing at boot
+		pass = "0"
+	case "ext4":
+		options = "defaults,errors=remount-ro"
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by fsify\n")
+	b.WriteString("# <file system>\t<mount point>\t<type>\t<options>\t<dump>\t<pass>\n")
+	fmt.Fprintf(&b, "%s\t/\t%s\t%s\t0\t%s\n", source, fsType, options, pass)
+	for _, mount := range g.Tmpfs {
+		dir, opts, _ := strings.Cut(mount, ":")
+		if opts == "" {
+			opts = "defaults"
+		}
+		fmt.Fprintf(&b, "tmpfs\t%s\ttmpfs\t%s\t0\t0\n", dir, opts)
+	}
+	return b.String()
+}
+
+// hosts renders /etc/hosts with loopback entries and the host name.
+func (g *guestConfig) hosts() string {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	if g.Hostname != "" {
+		short, _, _ := strings.Cut(g.Hostname, ".")
+		names := g.Hostname
+		if short != g.Hostname {
+			names += " " + short
+		}
+		fmt.Fprintf(&b, "127.0.1.1\t%s\n", names)
+	}
+	b.WriteString("::1\t\tlocalhost ip6-localhost ip6-loopback\n")
+	b.WriteString("ff02::1\t\tip6-allnodes\n")
+	b.WriteString("ff02::2\t\tip6-allrouters\n")
+	return b.String()
+}
+
+// configureGuest writes /etc/hostname, /etc/hosts, /etc/resolv.conf and
+// /etc/fstab into the rootfs. /etc/hosts is also written when the image's
+// copy is missing or empty, as container images ship it as a placeholder.
+func configureGuest(ctx *ConversionContext) error {
+	g := ctx.Guest
+	if g == nil {
+		// Nothing requested, but the placeholder still needs defaults
+		g = &guestConfig{}
+	}
+
+	if g.Hostname != "" {
+		if err := writeRootfsFile(ctx, "etc/hostname", []byte(g.Hostname+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if size, ok := ctx.rootfsFileSize("etc/hosts"); g.Hostname != "" || !ok || size == 0 {
+		if err := writeRootfsFile(ctx, "etc/hosts", []byte(g.hosts()), 0644); err != nil {
+			return err
+		}
+	}
+	if len(g.DNS) > 0 {
+		var b strings.Builder
+		b.WriteString("# Generated by fsify\n")
+		for _, server := range g.DNS {
+			fmt.Fprintf(&b, "nameserver %s\n", server)
+		}
+		if err := writeRootfsFile(ctx, "etc/resolv.conf", []byte(b.String()), 0644); err != nil {
+			return err
+		}
+	}
+	if g.Fstab == "auto" {
+		if err := writeRootfsFile(ctx, "etc/fstab", []byte(g.fstab(ctx.FsType, ctx.FsOptions)), 0644); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Verbose && ctx.Guest != nil {
+		fmt.Printf("%s Guest config: hostname=%q dns=%v fstab=%q\n", colorize("│", "blue", ctx.NoColor), g.Hostname, g.DNS, g.Fstab)
+	}
+	return nil
+}
+
+// rootfsFileSize returns the size of a path in the rootfs or merged tree.
+// Symlinks in the parent directories are followed within the tree, so
+// /bin/sh is found when bin links to usr/bin. A symlink as the final
+// component counts as present, with the size of the link itself.
+func (ctx *ConversionContext) rootfsFileSize(relPath string) (int64, bool) {
+	relPath = cleanTarPath(relPath)
+	if ctx.Merged != nil {
+		relPath, err := ctx.Merged.resolveParent(relPath)
+		if err != nil {
+			return 0, false
+		}
+		if extra, ok := ctx.Merged.Extra[relPath]; ok {
+			if extra.Linkname != "" {
+				return int64(len(extra.Linkname)), true
+			}
+			return int64(len(extra.Data)), true
+		}
+		if entry, ok := ctx.Merged.Entries[relPath]; ok {
+			if entry.Header.Linkname != "" {
+				return int64(len(entry.Header.Linkname)), true
+			}
+			return entry.Header.Size, true
+		}
+		return 0, false
+	}
+	parent, err := resolveInRoot(ctx.rootfsPath(), path.Dir(relPath))
+	if err != nil {
+		return 0, false
+	}
+	info, err := os.Lstat(filepath.Join(parent, path.Base(relPath)))
+	if err != nil {
+		return 0, false
+	}
+	return info.Size(), true
+}
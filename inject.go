@@ -0,0 +1,483 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootfsAddition is one --add: a host file or directory placed in the rootfs.
+type rootfsAddition struct {
+	Source string
+	Dest   string      // Absolute path in the image
+	Mode   os.FileMode // Mode for added files; 0 keeps the source mode
+	Uid    int
+	Gid    int
+}
+
+// addedContent records an --add or --add-tar in the build info and provenance.
+type addedContent struct {
+	Type   string `json:"type"` // file, dir or tar
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+	Mode   string `json:"mode,omitempty"`
+	Owner  string `json:"owner,omitempty"`
+	Digest string `json:"digest"` // Of the file or tar; of the entry listing for a directory
+}
+
+// parseAddition parses src:dst[:mode[:uid:gid]]. Files are owned by root
+// unless uid:gid is given.
+func parseAddition(spec string) (rootfsAddition, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 && len(parts) != 3 && len(parts) != 5 {
+		return rootfsAddition{}, fmt.Errorf("invalid --add %q: expected src:dst[:mode[:uid:gid]]", spec)
+	}
+	add := rootfsAddition{Source: parts[0], Dest: parts[1]}
+	if add.Source == "" || !path.IsAbs(add.Dest) {
+		return rootfsAddition{}, fmt.Errorf("invalid --add %q: the destination must be an absolute path", spec)
+	}
+	if len(parts) >= 3 && parts[2] != "" {
+		mode, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil || mode > 07777 {
+			return rootfsAddition{}, fmt.Errorf("invalid --add %q: mode must be octal, e.g. 0755", spec)
+		}
+		add.Mode = os.FileMode(mode)
+	}
+	if len(parts) == 5 {
+		uid, uidErr := strconv.ParseUint(parts[3], 10, 32)
+		gid, gidErr := strconv.ParseUint(parts[4], 10, 32)
+		if uidErr != nil || gidErr != nil {
+			return rootfsAddition{}, fmt.Errorf("invalid --add %q: uid and gid must be numeric", spec)
+		}
+		add.Uid, add.Gid = int(uid), int(gid)
+	}
+	if _, err := os.Stat(add.Source); err != nil {
+		return rootfsAddition{}, fmt.Errorf("invalid --add %q: %w", spec, err)
+	}
+	// Recorded in provenance, so make it independent of the working directory
+	abs, err := filepath.Abs(add.Source)
+	if err != nil {
+		return rootfsAddition{}, err
+	}
+	add.Source = abs
+	return add, nil
+}
+
+// addFilesToRootfs applies every --add-tar and then every --add to the
+// unpacked rootfs, in the order given, and records them for provenance.
+func addFilesToRootfs(ctx *ConversionContext) error {
+	root := ctx.rootfsPath()
+	for _, tarPath := range ctx.AddTars {
+		digest, err := extractTarToRootfs(root, tarPath)
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", tarPath, err)
+		}
+		ctx.Added = append(ctx.Added, addedContent{Type: "tar", Source: tarPath, Dest: "/", Digest: digest})
+		if ctx.Verbose {
+			fmt.Printf("%s Extracted %s into /\n", colorize("│", "blue", ctx.NoColor), tarPath)
+		}
+	}
+
+	for _, add := range ctx.Additions {
+		record, err := addToRootfs(root, add)
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", add.Source, err)
+		}
+		ctx.Added = append(ctx.Added, record)
+		if ctx.Verbose {
+			fmt.Printf("%s Added %s as %s\n", colorize("│", "blue", ctx.NoColor), add.Source, record.Dest)
+		}
+	}
+	return nil
+}
+
+// addToRootfs copies a file or directory into the rootfs with Docker COPY
+// semantics: a file copied to a directory (or a path ending in /) keeps its
+// name, and a directory's contents are merged into the destination.
+func addToRootfs(root string, add rootfsAddition) (addedContent, error) {
+	info, err := os.Stat(add.Source)
+	if err != nil {
+		return addedContent{}, err
+	}
+	record := addedContent{Type: "file", Source: add.Source, Dest: add.Dest, Owner: fmt.Sprintf("%d:%d", add.Uid, add.Gid)}
+	if add.Mode != 0 {
+		record.Mode = fmt.Sprintf("%04o", add.Mode)
+	}
+
+	if !info.IsDir() {
+		dest := add.Dest
+		if strings.HasSuffix(dest, "/") || isRootfsDir(root, dest) {
+			dest = path.Join(dest, filepath.Base(add.Source))
+		}
+		record.Dest = path.Clean(dest)
+		hdr, err := additionHeader(add, add.Source, info, record.Dest)
+		if err != nil {
+			return addedContent{}, err
+		}
+		f, err := os.Open(add.Source)
+		if err != nil {
+			return addedContent{}, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if err := writeRootfsEntry(root, hdr, io.TeeReader(f, h)); err != nil {
+			return addedContent{}, err
+		}
+		record.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+		return record, nil
+	}
+
+	// A directory is digested as a listing of its entries, in walk order
+	record.Type = "dir"
+	record.Dest = path.Clean(add.Dest)
+	listing := sha256.New()
+	err = filepath.WalkDir(add.Source, func(srcPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(add.Source, srcPath)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		hdr, err := additionHeader(add, srcPath, info, path.Join(record.Dest, filepath.ToSlash(relPath)))
+		if err != nil {
+			return err
+		}
+
+		var h hash.Hash
+		switch {
+		case hdr.Typeflag == tar.TypeDir && isRootfsDir(root, hdr.Name):
+			// An existing directory such as /etc keeps its own owner and mode
+		case hdr.Typeflag == tar.TypeReg:
+			f, err := os.Open(srcPath)
+			if err != nil {
+				return err
+			}
+			h = sha256.New()
+			err = writeRootfsEntry(root, hdr, io.TeeReader(f, h))
+			f.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			if err := writeRootfsEntry(root, hdr, nil); err != nil {
+				return err
+			}
+		}
+		sum := ""
+		if h != nil {
+			sum = hex.EncodeToString(h.Sum(nil))
+		}
+		fmt.Fprintf(listing, "%s %04o %d:%d %s %s\n", relPath, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Linkname, sum)
+		return nil
+	})
+	if err != nil {
+		return addedContent{}, err
+	}
+	record.Digest = "sha256:" + hex.EncodeToString(listing.Sum(nil))
+	return record, nil
+}
+
+// additionHeader describes one source path as a tar header at dest, with the
+// --add mode and owner applied.
+func additionHeader(add rootfsAddition, srcPath string, info os.FileInfo, dest string) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(srcPath); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, fmt.Errorf("cannot add %s: %w", srcPath, err)
+	}
+	hdr.Name = dest
+	hdr.Uid, hdr.Gid = add.Uid, add.Gid
+	hdr.Uname, hdr.Gname = "", ""
+	if add.Mode != 0 && hdr.Typeflag == tar.TypeReg {
+		hdr.Mode = int64(add.Mode)
+	}
+	return hdr, nil
+}
+
+// extractTarToRootfs extracts a plain or gzip-compressed tar over the rootfs,
+// keeping the owners and modes it records. It returns the tar's digest.
+func extractTarToRootfs(root, tarPath string) (string, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	br := bufio.NewReader(io.TeeReader(f, h))
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	if err := applyTarToRootfs(root, r); err != nil {
+		return "", err
+	}
+	// Hash any trailing padding too, so the digest covers the whole file
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// applyTarToRootfs extracts an uncompressed tar stream over the rootfs,
+// applying its whiteouts to what was there before the tar.
+func applyTarToRootfs(root string, r io.Reader) error {
+	// Host paths the tar created, and their parents: its own whiteouts
+	// never hide them, even when an opaque marker comes after them
+	created := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar: %w", err)
+		}
+		hdr.Name = "/" + cleanTarPath(hdr.Name)
+		if base := path.Base(hdr.Name); strings.HasPrefix(base, ".wh.") {
+			if err := applyWhiteout(root, path.Dir(hdr.Name), base, created); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeRootfsEntry(root, hdr, tr); err != nil {
+			return err
+		}
+		rel := cleanTarPath(hdr.Name)
+		parent, err := resolveInRoot(root, path.Dir(rel))
+		if err != nil {
+			return err
+		}
+		for p := filepath.Join(parent, path.Base(rel)); len(p) > len(root); p = filepath.Dir(p) {
+			created[p] = true
+		}
+	}
+}
+
+// applyWhiteout handles an OCI whiteout in an overlay tar: .wh.<name>
+// deletes name from the rootfs, .wh..wh..opq empties the directory.
+// Entries created by the same tar are kept.
+func applyWhiteout(root, dir, base string, created map[string]bool) error {
+	parent, err := resolveInRoot(root, dir)
+	if err != nil {
+		return err
+	}
+	if base == ".wh..wh..opq" {
+		entries, err := os.ReadDir(parent)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, entry := range entries {
+			if err := removeLowerPath(filepath.Join(parent, entry.Name()), created); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return removeLowerPath(filepath.Join(parent, strings.TrimPrefix(base, ".wh.")), created)
+}
+
+// removeLowerPath deletes p and everything below it that the current tar
+// did not create, like mergedTree.removeLower does in stream mode.
+func removeLowerPath(p string, created map[string]bool) error {
+	if !created[p] {
+		return os.RemoveAll(p)
+	}
+	info, err := os.Lstat(p)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := removeLowerPath(filepath.Join(p, entry.Name()), created); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRootfsEntry creates one tar entry in the rootfs, replacing whatever
+// is at that path unless both are directories. Parent directories that do
+// not exist are created owned by root.
+func writeRootfsEntry(root string, hdr *tar.Header, data io.Reader) error {
+	rel := cleanTarPath(hdr.Name)
+	if rel == "" {
+		// The image's root directory keeps its own owner and mode
+		return nil
+	}
+	parent, err := resolveInRoot(root, path.Dir(rel))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("failed to create directory for /%s: %w", rel, err)
+	}
+	dest := filepath.Join(parent, path.Base(rel))
+
+	existing, err := os.Lstat(dest)
+	if err == nil && existing.Mode()&os.ModeSymlink != 0 && hdr.Typeflag == tar.TypeDir && isRootfsDir(root, rel) {
+		// Keep directory symlinks such as /lib -> usr/lib, like tar --keep-directory-symlink
+		return nil
+	}
+	if err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("failed to replace /%s: %w", rel, err)
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(dest, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("failed to create /%s: %w", rel, err)
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to create /%s: %w", rel, err)
+		}
+		if _, err := io.Copy(f, data); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write /%s: %w", rel, err)
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write /%s: %w", rel, err)
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, dest); err != nil {
+			return fmt.Errorf("failed to create /%s: %w", rel, err)
+		}
+	case tar.TypeLink:
+		targetRel := cleanTarPath(hdr.Linkname)
+		targetDir, err := resolveInRoot(root, path.Dir(targetRel))
+		if err != nil {
+			return err
+		}
+		if err := os.Link(filepath.Join(targetDir, path.Base(targetRel)), dest); err != nil {
+			return fmt.Errorf("failed to link /%s to /%s: %w", rel, targetRel, err)
+		}
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			mode = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			mode = unix.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(dest, mode|uint32(hdr.Mode&07777), dev); err != nil {
+			return fmt.Errorf("failed to create /%s: %w", rel, err)
+		}
+	default:
+		return fmt.Errorf("unsupported entry type %q for /%s", hdr.Typeflag, rel)
+	}
+	return applyEntryMetadata(dest, hdr)
+}
+
+// applyEntryMetadata sets the owner, mode and modification time from hdr.
+// chown clears setuid, so it runs first.
+func applyEntryMetadata(dest string, hdr *tar.Header) error {
+	if err := os.Lchown(dest, hdr.Uid, hdr.Gid); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %w", dest, err)
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	if err := unix.Chmod(dest, uint32(hdr.Mode&07777)); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", dest, err)
+	}
+	if !hdr.ModTime.IsZero() {
+		if err := os.Chtimes(dest, hdr.ModTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("failed to set times of %s: %w", dest, err)
+		}
+	}
+	return nil
+}
+
+// isRootfsDir reports whether p is a directory in the rootfs.
+func isRootfsDir(root, p string) bool {
+	dir, err := resolveInRoot(root, strings.TrimPrefix(path.Clean(p), "/"))
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// resolveInRoot resolves rel inside root, following symlinks as the image
+// would see them at boot: absolute targets are relative to root and ".."
+// never leaves it. The image's symlinks can therefore never send a write to
+// the host. Components that do not exist yet are kept as they are.
+func resolveInRoot(root, rel string) (string, error) {
+	var resolved []string
+	pending := strings.Split(cleanTarPath(rel), "/")
+	for links := 0; len(pending) > 0; {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		current := filepath.Join(root, filepath.Join(append(resolved, name)...))
+		info, err := os.Lstat(current)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, name)
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in /%s", rel)
+		}
+		target, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(append([]string{root}, resolved...)...), nil
+}
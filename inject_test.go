@@ -0,0 +1,101 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestApplyTarToRootfsOpaqueWhiteoutHidesOnlyLower(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"etc/old.conf", "etc/conf.d/lower.conf", "var/lib/gone"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte("lower"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The opaque marker for etc comes after the layer's own etc entries
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/conf.d/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "etc/conf.d/upper.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "etc/new.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "etc/.wh..wh..opq", Typeflag: tar.TypeReg},
+		{Name: "var/lib/.wh.gone", Typeflag: tar.TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("upper"))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyTarToRootfs(root, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"etc/new.conf":          true,
+		"etc/conf.d/upper.conf": true,
+		"etc/old.conf":          false,
+		"etc/conf.d/lower.conf": false,
+		"var/lib/gone":          false,
+		"var/lib":               true,
+	} {
+		_, err := os.Lstat(filepath.Join(root, name))
+		if got := err == nil; got != want {
+			t.Errorf("/%s present = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestAddToRootfsKeepsExistingDirectoryMetadata(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "app"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "app", "app.conf"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := addToRootfs(root, rootfsAddition{Source: src, Dest: "/etc", Uid: 1000, Gid: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]struct {
+		mode os.FileMode
+		uid  uint32
+	}{
+		"etc":     {0755, 0},
+		"etc/app": {0750, 1000},
+	} {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		st := info.Sys().(*syscall.Stat_t)
+		if info.Mode().Perm() != want.mode || st.Uid != want.uid {
+			t.Errorf("/%s is %04o owned by %d, want %04o owned by %d", name, info.Mode().Perm(), st.Uid, want.mode, want.uid)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/app/app.conf")); err != nil {
+		t.Error(err)
+	}
+}
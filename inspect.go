@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// fsSummary is what can be learned from an image's superblock alone.
+type fsSummary struct {
+	Type       string `json:"type"`
+	SizeBytes  int64  `json:"sizeBytes"` // Filesystem size as recorded in the superblock
+	FileBytes  int64  `json:"fileBytes"` // Size of the image file
+	BlockSize  int64  `json:"blockSize,omitempty"`
+	UUID       string `json:"uuid,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Inodes     int64  `json:"inodes,omitempty"`
+	FreeInodes int64  `json:"freeInodes,omitempty"`
+	FreeBytes  int64  `json:"freeBytes,omitempty"`
+	Features   string `json:"features,omitempty"`
+}
+
+// imageConfigSummary is the runtime part of the embedded OCI image config.
+type imageConfigSummary struct {
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+}
+
+// inspectReport is the output of `fsify inspect`.
+type inspectReport struct {
+	Path       string              `json:"path"`
+	Filesystem *fsSummary          `json:"filesystem"`
+	Build      *buildInfo          `json:"build,omitempty"`
+	Config     *imageConfigSummary `json:"config,omitempty"`
+	Warnings   []string            `json:"warnings,omitempty"`
+}
+
+// runInspect implements `fsify inspect [--json] <image>`.
+func runInspect(args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	jsonOutput := fs.Bool("json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		fmt.Println("USAGE:\n    fsify inspect [--json] <image>")
+	}
+	fs.BoolVar(&noColor, "no-color", false, "Disable colored output")
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+
+	report, err := inspectImage(positional[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", colorize("❌ Error:", "red", noColor), err)
+		return 1
+	}
+
+	if *jsonOutput {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return 0
+	}
+	printInspectReport(report)
+	return 0
+}
+
+// inspectImage reads the superblock and the files fsify embeds, without mounting.
+func inspectImage(path string) (*inspectReport, error) {
+	summary, err := readSuperblock(path)
+	if err != nil {
+		return nil, err
+	}
+	report := &inspectReport{Path: path, Filesystem: summary}
+
+	if data, err := readImageFile(path, summary.Type, buildInfoPath); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("build info: %v", err))
+	} else {
+		var info buildInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("build info is not valid JSON: %v", err))
+		} else {
+			report.Build = &info
+		}
+	}
+
+	if data, err := readImageFile(path, summary.Type, "etc/fsify-entrypoint"); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("OCI config: %v", err))
+	} else {
+		if config, err := parseOciConfig(data); err != nil {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("OCI config is not valid JSON: %v", err))
+		} else {
+			c := config.Config
+			report.Config = &imageConfigSummary{Entrypoint: c.Entrypoint, Cmd: c.Cmd, Env: c.Env, User: c.User, WorkingDir: c.WorkingDir}
+		}
+	}
+	return report, nil
+}
+
+// readAt reads n bytes at off, or returns nil if the file is too short.
+func readAt(f *os.File, off int64, n int) []byte {
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil
+	}
+	return buf
+}
+
+// cString trims a fixed-size, NUL-padded superblock string.
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// formatUUID renders 16 raw bytes as a canonical UUID, or "" if all zero.
+func formatUUID(b []byte) string {
+	if len(b) != 16 || bytes.Equal(b, make([]byte, 16)) {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// readSuperblock identifies the filesystem in an image file from its magic
+// numbers and decodes the fields fsify reports.
+func readSuperblock(path string) (*fsSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	summary := &fsSummary{FileBytes: info.Size()}
+	le, be := binary.LittleEndian, binary.BigEndian
+
+	// squashfs and xfs keep their superblock at offset 0
+	if sb := readAt(f, 0, 256); sb != nil {
+		switch {
+		case string(sb[0:4]) == "hsqs":
+			compressors := map[uint16]string{1: "gzip", 2: "lzma", 3: "lzo", 4: "xz", 5: "lz4", 6: "zstd"}
+			summary.Type = "squashfs"
+			summary.Inodes = int64(le.Uint32(sb[4:]))
+			summary.BlockSize = int64(le.Uint32(sb[12:]))
+			summary.SizeBytes = int64(le.Uint64(sb[40:]))
+			summary.Features = "compression=" + compressors[le.Uint16(sb[20:])]
+			return summary, nil
+		case string(sb[0:4]) == "XFSB":
+			summary.Type = "xfs"
+			summary.BlockSize = int64(be.Uint32(sb[4:]))
+			summary.SizeBytes = int64(be.Uint64(sb[8:])) * summary.BlockSize
+			summary.UUID = formatUUID(sb[32:48])
+			summary.Label = cString(sb[108:120])
+			summary.Inodes = int64(be.Uint64(sb[128:]))
+			summary.FreeInodes = int64(be.Uint64(sb[136:]))
+			summary.FreeBytes = int64(be.Uint64(sb[144:])) * summary.BlockSize
+			return summary, nil
+		}
+	}
+
+	// ext2/3/4 and erofs keep theirs at offset 1024
+	if sb := readAt(f, 1024, 1024); sb != nil {
+		if le.Uint16(sb[0x38:]) == 0xEF53 {
+			compat, incompat := le.Uint32(sb[0x5C:]), le.Uint32(sb[0x60:])
+			summary.Type = "ext2"
+			if compat&0x4 != 0 {
+				summary.Type = "ext3"
+			}
+			if incompat&0x40 != 0 {
+				summary.Type = "ext4"
+			}
+			summary.BlockSize = 1024 << le.Uint32(sb[0x18:])
+			blocks := int64(le.Uint32(sb[0x04:]))
+			freeBlocks := int64(le.Uint32(sb[0x0C:]))
+			if incompat&0x80 != 0 { // 64bit
+				blocks |= int64(le.Uint32(sb[0x150:])) << 32
+				freeBlocks |= int64(le.Uint32(sb[0x158:])) << 32
+			}
+			summary.SizeBytes = blocks * summary.BlockSize
+			summary.FreeBytes = freeBlocks * summary.BlockSize
+			summary.Inodes = int64(le.Uint32(sb[0x00:]))
+			summary.FreeInodes = int64(le.Uint32(sb[0x10:]))
+			summary.UUID = formatUUID(sb[0x68:0x78])
+			summary.Label = cString(sb[0x78:0x88])
+			if compat&0x4 == 0 {
+				summary.Features = "no journal"
+			}
+			return summary, nil
+		}
+		if le.Uint32(sb[0:]) == 0xE0F5E1E2 {
+			summary.Type = "erofs"
+			summary.BlockSize = 1 << sb[0x0C]
+			summary.Inodes = int64(le.Uint64(sb[0x10:]))
+			summary.SizeBytes = int64(le.Uint32(sb[0x24:])) * summary.BlockSize
+			summary.UUID = formatUUID(sb[0x30:0x40])
+			summary.Label = cString(sb[0x40:0x50])
+			return summary, nil
+		}
+	}
+
+	// btrfs keeps its primary superblock at 64K
+	if sb := readAt(f, 0x10000, 0x1000); sb != nil && string(sb[0x40:0x48]) == "_BHRfS_M" {
+		summary.Type = "btrfs"
+		summary.UUID = formatUUID(sb[0x20:0x30])
+		summary.SizeBytes = int64(le.Uint64(sb[0x70:]))
+		summary.FreeBytes = summary.SizeBytes - int64(le.Uint64(sb[0x78:]))
+		summary.BlockSize = int64(le.Uint32(sb[0x90:]))
+		summary.Label = cString(sb[0x12B : 0x12B+256])
+		return summary, nil
+	}
+
+	return nil, fmt.Errorf("%s: unrecognized filesystem image", path)
+}
+
+// readImageFile extracts one file from an unmounted image using the
+// filesystem's own userspace tools.
+func readImageFile(imagePath, fsType, relPath string) ([]byte, error) {
+	absPath := "/" + cleanTarPath(relPath)
+
+	var cmd *exec.Cmd
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("debugfs", "-R", "cat "+absPath, imagePath)
+	case "squashfs":
+		cmd = exec.Command("unsquashfs", "-cat", imagePath, absPath)
+	case "erofs":
+		cmd = exec.Command("dump.erofs", "--cat", "--path="+absPath, imagePath)
+	default:
+		return nil, fmt.Errorf("reading files from %s images without mounting is not supported", fsType)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if _, lookErr := exec.LookPath(cmd.Path); lookErr != nil {
+			return nil, fmt.Errorf("%s is not installed", cmd.Args[0])
+		}
+		return nil, fmt.Errorf("%s not found in image", absPath)
+	}
+	// debugfs exits 0 and reports lookup failures on stderr
+	if stdout.Len() == 0 && strings.Contains(stderr.String(), "not found") {
+		return nil, fmt.Errorf("%s not found in image", absPath)
+	}
+	return io.ReadAll(&stdout)
+}
+
+func printInspectReport(r *inspectReport) {
+	label := func(name string) string {
+		return colorize(fmt.Sprintf("%-12s", name+":"), "cyan", noColor)
+	}
+	fs := r.Filesystem
+
+	fmt.Printf("%s %s\n", label("Image"), r.Path)
+	fmt.Printf("%s %s\n", label("Filesystem"), fs.Type)
+	fmt.Printf("%s %s (file %s)\n", label("Size"), formatBytes(fs.SizeBytes), formatBytes(fs.FileBytes))
+	if fs.FreeBytes > 0 {
+		fmt.Printf("%s %s, %d inodes\n", label("Free"), formatBytes(fs.FreeBytes), fs.FreeInodes)
+	}
+	if fs.UUID != "" {
+		fmt.Printf("%s %s\n", label("UUID"), fs.UUID)
+	}
+	if fs.Label != "" {
+		fmt.Printf("%s %s\n", label("Label"), fs.Label)
+	}
+	if fs.Features != "" {
+		fmt.Printf("%s %s\n", label("Features"), fs.Features)
+	}
+
+	if b := r.Build; b != nil {
+		fmt.Printf("%s %s\n", label("Source"), b.Source)
+		if b.Digest != "" {
+			fmt.Printf("%s %s\n", label("Digest"), b.Digest)
+		}
+		if b.Platform != "" {
+			fmt.Printf("%s %s\n", label("Platform"), b.Platform)
+		}
+		if len(b.Layers) > 0 {
+			fmt.Printf("%s %d\n", label("Layers"), len(b.Layers))
+		}
+		for _, overlay := range b.Overlays {
+			fmt.Printf("%s %s (%s, %d layers)\n", label("Overlay"), overlay.Source, overlay.Digest, len(overlay.Layers))
+		}
+		if b.Runtime != nil && b.Runtime.Service != "" {
+			fmt.Printf("%s %s\n", label("Service"), b.Runtime.Service)
+		}
+		fmt.Printf("%s fsify %s (built %s)\n", label("Built with"), b.FsifyVersion, b.FsifyBuildDate)
+		if b.Timestamp != "" {
+			fmt.Printf("%s %s\n", label("Built at"), b.Timestamp)
+		}
+		options, _ := json.Marshal(b.Options)
+		fmt.Printf("%s %s\n", label("Options"), options)
+	}
+
+	if c := r.Config; c != nil {
+		if len(c.Entrypoint) > 0 {
+			fmt.Printf("%s %q\n", label("Entrypoint"), c.Entrypoint)
+		}
+		if len(c.Cmd) > 0 {
+			fmt.Printf("%s %q\n", label("Cmd"), c.Cmd)
+		}
+		if c.User != "" {
+			fmt.Printf("%s %s\n", label("User"), c.User)
+		}
+		if c.WorkingDir != "" {
+			fmt.Printf("%s %s\n", label("WorkingDir"), c.WorkingDir)
+		}
+		if len(c.Env) > 0 {
+			fmt.Printf("%s\n", label("Env"))
+			for _, env := range c.Env {
+				fmt.Printf("    %s\n", env)
+			}
+		}
+	}
+
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(os.Stderr, "%s %s\n", colorize("⚠️", "yellow", noColor), warning)
+	}
+}
@@ -1,8 +1,7 @@
 package main
 
-import ( 
+import (
 	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
@@ -10,8 +9,10 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,22 +21,18 @@ import (
 
 // Configuration flags
 var (
-	verbose    bool
-	showHelp   bool
+	verbose     bool
+	showHelp    bool
 	showVersion bool
-	outputFile string
-	quiet      bool
-	noColor    bool
-	forceColor bool
-	fsType     string
-	bufferSize int // In MB
-	preallocate bool
-	dualOutput bool
+	quiet       bool
+	noColor     bool
+	forceColor  bool
+	opts        = defaultConvertOptions()
 )
 
 // Version information
 const (
-	Version = "1.0.0"
+	Version   = "1.0.0"
 	BuildDate = "2025-09-29"
 )
 
@@ -51,78 +48,192 @@ const (
 
 // OCI JSON structures
 type OCIIndex struct {
-	Manifests []OCIManifest `json:"manifests"`
+	Manifests []OCDescriptor `json:"manifests"`
 }
 
 type OCIManifest struct {
-	Config OCDescriptor `json:"config"`
+	Config OCDescriptor   `json:"config"`
+	Layers []OCDescriptor `json:"layers"`
 }
 
 type OCDescriptor struct {
-	Digest string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
 }
 
 // ConversionContext holds all state and configuration for a conversion task.
 type ConversionContext struct {
-	TempDir       string
-	OciLayoutPath string // Directory for the raw OCI image
-	UnpackedPath  string // Directory for the final, unpacked rootfs
-	ImagePath     string
-	SquashfsPath  string
-	MountPoint    string
-	LoopDevicePath string // Explicit loop device path like "/dev/loop0"
-	FinalPath     string
-	FinalSquashfsPath string
-	ImageRef      string
-	FsType        string
-	BufferSize    int // In MB
-	Preallocate   bool
-	DualOutput    bool
-	Verbose       bool
-	Quiet         bool
-	NoColor       bool
-}
-
-func init() {
-	flag.BoolVar(&showHelp, "h", false, "Show this help message")
-	flag.BoolVar(&showVersion, "version", false, "Show version information")
-	flag.BoolVar(&verbose, "v", false, "Enable verbose output with progress details")
-	flag.StringVar(&outputFile, "o", "", "Output file path (default: <image-name>.img)")
-	flag.BoolVar(&quiet, "q", false, "Quiet mode (minimal output, just final path)")
-	flag.BoolVar(&noColor, "no-color", false, "Disable colored output")
-	flag.StringVar(&fsType, "fs", "ext4", "Filesystem type for the image (e.g., ext4, xfs)")
-	flag.IntVar(&bufferSize, "s", 50, "Buffer size in MB to add to the image")
-	flag.BoolVar(&preallocate, "preallocate", false, "Preallocate disk space (fallocate) instead of sparse allocation")
-	flag.BoolVar(&dualOutput, "dual-output", false, "Also generate a squashfs image alongside the primary filesystem")
-}
-
-func main() {
-	flag.Parse()
+	TempDir             string
+	WorkDir             string // Parent of TempDir, empty for $TMPDIR
+	KeepWorkDir         bool
+	OciLayoutPath       string // Directory for the raw OCI image
+	UnpackedPath        string // Directory for the final, unpacked rootfs
+	ImagePath           string
+	SquashfsPath        string
+	MountPoint          string
+	LoopDevicePath      string // Explicit loop device path like "/dev/loop0"
+	OutputFile          string // -o, overrides the name template
+	OutputDir           string
+	NameTemplate        string
+	Force               bool // Replace existing outputs
+	FinalPath           string
+	FinalSquashfsPath   string
+	ProvenancePath      string // In-toto provenance in the work directory
+	FinalProvenancePath string // In-toto provenance sidecar next to FinalPath
+	SBOMPath            string // SBOM in the work directory
+	FinalSBOMPath       string
+	ManifestPath        string // File manifest in the work directory, empty when not requested
+	FinalManifestPath   string
+	ImageRef            string
+	ImageDigest         string              // Resolved manifest digest the image was pulled by
+	LocalDigest         string              // Manifest digest of a docker-daemon copy; no registry serves it
+	RegistryManifests   map[string][]byte   // Raw registry manifests by reference, fetched once per run
+	Overlays            []overlayImage      // --overlay images, unpacked over the base in order
+	EntrypointFrom      string              // Image whose Entrypoint and Cmd are kept, empty for the base
+	ImageConfig         *OCIConfig          // Config of the image, merged with the overlays'; nil if unreadable
+	Runtime             *runtimeTranslation // What the image config became in the guest
+	Init                string              // "systemd" to enable the generated unit in the image's systemd
+	Cache               *blobCache          // Layer cache; nil with --no-cache
+	Additions           []rootfsAddition    // --add, applied after AddTars
+	AddTars             []string
+	Added               []addedContent // What was added, for provenance
+	Exclude             *excluder      // nil when nothing is excluded
+	PrunedPaths         int
+	PrunedBytes         int64
+	Guest               *guestConfig     // nil when no guest options are set
+	CloudInit           *cloudInitConfig // nil without --cloud-init
+	CloudInitPath       string
+	FinalCloudInitPath  string
+	Access              *accessConfig // nil without --user, --ssh-authorized-key or --root-password-hash
+	Signature           signaturePolicy
+	FsType              string
+	BufferSize          int // In MB
+	Preallocate         bool
+	DualOutput          bool
+	Stream              bool          // Build directly from layer tarballs, without unpacking or mounting
+	Merged              *mergedTree   // Final layer tree, populated in stream mode
+	Jobs                int           // Parallel file copy workers
+	Estimate            *sizeEstimate // Up-front size and inode estimate for the primary image
+	TargetSize          int64         // Exact final size in bytes (--size), 0 to shrink
+	FreeSpace           int64         // Free bytes to leave after shrinking
+	FreePercent         float64       // Free space to leave after shrinking, as a percentage
+	MinInodes           int64
+	FsOptions           fsOptions  // Typed mkfs tuning options
+	BuildInfo           *buildInfo // Record embedded at /etc/fsify/build.json
+	StartTime           time.Time
+	SBOMFormat          string // spdx-json or cyclonedx-json, empty for no SBOM
+	SBOMEmbed           bool
+	Verbose             bool
+	Quiet               bool
+	NoColor             bool
+}
+
+// convertFlags registers the conversion options on fs, with GNU-style long
+// names and the short forms the README documents.
+func convertFlags(fs *flag.FlagSet, o *convertOptions) {
+	fs.BoolVar(&showHelp, "help", false, "Show this help message")
+	fs.BoolVar(&showVersion, "version", false, "Show version information")
+	fs.BoolVar(&verbose, "verbose", false, "Enable verbose output with progress details")
+	fs.BoolVar(&quiet, "quiet", false, "Quiet mode (minimal output, just final path)")
+	fs.BoolVar(&noColor, "no-color", false, "Disable colored output")
+	fs.StringVar(&o.Output, "output", "", "Output file path (default: <image-name>.img)")
+	fs.StringVar(&o.OutputDir, "output-dir", "", "Directory for the image and its sidecars (default: current directory)")
+	fs.StringVar(&o.NameTemplate, "name-template", "", "Output file name template, e.g. '{{.Repo}}-{{.Tag}}-{{.Arch}}.{{.Ext}}'")
+	fs.BoolVar(&o.Force, "force", false, "Overwrite existing output files")
+	fs.StringVar(&o.WorkDir, "workdir", "", "Directory for intermediate files (default: $TMPDIR)")
+	fs.BoolVar(&o.KeepWorkDir, "keep-workdir", false, "Keep intermediate files after the build, for debugging")
+	fs.StringVar(&o.CacheDir, "cache-dir", o.CacheDir, "Directory for cached image layers")
+	fs.BoolVar(&o.NoCache, "no-cache", false, "Do not read or write the layer cache")
+	fs.StringVar(&o.FsType, "filesystem", o.FsType, "Filesystem type for the image (e.g., ext4, xfs)")
+	fs.IntVar(&o.BufferMB, "size-buffer", o.BufferMB, "Buffer size in MB to add to the image")
+	fs.BoolVar(&o.Preallocate, "preallocate", false, "Preallocate disk space (fallocate) instead of sparse allocation")
+	fs.BoolVar(&o.DualOutput, "dual-output", false, "Also generate a squashfs image alongside the primary filesystem")
+	fs.StringVar(&o.Size, "size", "", "Exact final image size, e.g. 2G (error if the content doesn't fit)")
+	fs.StringVar(&o.FreeSpace, "free-space", "", "Guaranteed free space after shrinking, e.g. 512M")
+	fs.Float64Var(&o.FreePercent, "free-percent", 0, "Guaranteed free space after shrinking, as a percentage of the image")
+	fs.Int64Var(&o.MinInodes, "min-inodes", 0, "Minimum number of inodes in the final image")
+	fs.StringVar(&o.Label, "label", "", "Filesystem label")
+	fs.StringVar(&o.UUID, "uuid", "", "Filesystem UUID (default: random)")
+	fs.IntVar(&o.BlockSize, "block-size", 0, "Filesystem block size in bytes (default: mkfs default)")
+	fs.IntVar(&o.InodeSize, "inode-size", 0, "Inode size in bytes (ext4, xfs)")
+	fs.IntVar(&o.InodeRatio, "inode-ratio", 0, "Bytes per inode (ext4; default: sized from the rootfs)")
+	fs.StringVar(&o.Ext4Features, "ext4-features", "", "Comma-separated ext4 features, ^ to disable (e.g. ^metadata_csum,inline_data)")
+	fs.BoolVar(&o.NoJournal, "no-journal", false, "Create ext4 without a journal (for read-only roots)")
+	fs.Float64Var(&o.ReservedPercent, "reserved-percent", o.ReservedPercent, "Percentage of ext4 blocks reserved for root (default: 5)")
+	fs.StringVar(&o.XFSReflink, "xfs-reflink", "", "Enable or disable xfs reflink support (on, off)")
+	fs.StringVar(&o.BtrfsCompress, "btrfs-compress", "", "Btrfs compression for the image and its files (zstd[:level], lzo, zlib[:level])")
+	fs.StringVar(&o.SBOM, "sbom", "", "Write an SBOM next to the output (spdx-json, cyclonedx-json)")
+	fs.BoolVar(&o.SBOMEmbed, "sbom-embed", false, "Also embed the SBOM in the image under /etc/fsify")
+	fs.BoolVar(&o.Manifest, "manifest", false, "Write a manifest of every file with its mode, owner and SHA-256 next to the output")
+	fs.BoolVar(&o.VerifySignature, "verify-signature", false, "Only convert images with a valid signature (needs --signature-key or --signature-policy)")
+	fs.Var(&o.SignatureKeys, "signature-key", "Public key (PEM) for cosign signatures; may be repeated")
+	fs.StringVar(&o.SignaturePolicy, "signature-policy", "", "containers-policy.json to enforce while pulling")
+	fs.BoolVar(&o.RequireDigest, "require-digest", false, "Reject image references that are not pinned by digest (name@sha256:...)")
+	fs.IntVar(&o.CopyJobs, "jobs", o.CopyJobs, "Number of parallel file copy workers")
+	fs.BoolVar(&o.Stream, "stream", false, "Stream merged layers straight into mkfs (no unpacked rootfs, no loop mount)")
+	fs.Var(&o.Add, "add", "Add a host file or directory to the rootfs: src:dst[:mode[:uid:gid]]; may be repeated")
+	fs.Var(&o.AddTar, "add-tar", "Extract a tar (optionally gzipped) over the rootfs; may be repeated")
+	fs.Var(&o.Exclude, "exclude", "Remove paths matching a glob from the rootfs (/abs/path/* or file name); may be repeated")
+	fs.Var(&o.ExcludeFrom, "exclude-from", "Read exclude patterns from a file, one per line; may be repeated")
+	fs.BoolVar(&o.Slim, "slim", false, "Remove package caches, docs, man pages and locales not in --keep-locales")
+	fs.StringVar(&o.KeepLocales, "keep-locales", o.KeepLocales, "Comma-separated locales --slim keeps")
+	fs.StringVar(&o.Hostname, "hostname", "", "Write /etc/hostname and a matching /etc/hosts entry")
+	fs.Var(&o.DNS, "dns", "Nameserver for /etc/resolv.conf; may be repeated")
+	fs.StringVar(&o.Fstab, "fstab", "", "Generate /etc/fstab: auto (root by label or UUID) or none")
+	fs.Var(&o.Tmpfs, "tmpfs", "Add a tmpfs mount to the generated fstab: /path[:options]; may be repeated")
+	fs.StringVar(&o.CloudInit, "cloud-init", "", "Write a NoCloud seed volume (<output>.cidata.img) with this user-data")
+	fs.StringVar(&o.MetaData, "meta-data", "", "meta-data for the cloud-init seed (default: instance-id from the image digest)")
+	fs.StringVar(&o.NetworkConfig, "network-config", "", "network-config for the cloud-init seed")
+	fs.Var(&o.Overlay, "overlay", "Unpack another image over the base image; may be repeated, applied in order")
+	fs.StringVar(&o.EntrypointFrom, "entrypoint-from", "", "With --overlay, the image whose Entrypoint and Cmd are kept (default: the base image)")
+	fs.StringVar(&o.Init, "init", "", "systemd: enable the service generated from the image config in the image's systemd")
+	fs.StringVar(&o.User, "user", "", "Create this login user (if missing) and give it the SSH keys")
+	fs.Var(&o.SSHAuthorizedKeys, "ssh-authorized-key", "Public key file for ~/.ssh/authorized_keys of --user, or root; may be repeated")
+	fs.StringVar(&o.RootPasswordHash, "root-password-hash", "", "crypt(3) hash for the root password, e.g. from mkpasswd -m sha-512")
+
+	aliasFlag(fs, "help", "h")
+	aliasFlag(fs, "verbose", "v")
+	aliasFlag(fs, "quiet", "q")
+	aliasFlag(fs, "output", "o")
+	aliasFlag(fs, "filesystem", "fs")
+	aliasFlag(fs, "size-buffer", "s")
+	aliasFlag(fs, "jobs", "j")
+}
+
+// runConvert implements `fsify [convert] [OPTIONS] <image>`.
+func runConvert(args []string) int {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	fs.Usage = showUsage
+	convertFlags(fs, &opts)
+	if err := applyEnv(fs); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", colorize("❌ Error:", "red", noColor), err)
+		return 1
+	}
+	positional := parseArgs(fs, args)
 
 	if showVersion {
-		fmt.Printf("fsify version %s (built %s)\n", Version, BuildDate)
-		return
+		return runVersion(nil)
 	}
 
 	if showHelp {
 		showUsage()
-		return
+		return 0
 	}
 
 	if os.Geteuid() != 0 {
 		fmt.Fprintln(os.Stderr, colorize("Error: This program requires root privileges for mount operations.", "red", false))
 		fmt.Fprintln(os.Stderr, "Please run with sudo.")
-		os.Exit(1)
+		return 1
 	}
 
-	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, colorize("Error: Missing Docker image reference", "red", false))
+	if len(positional) != 1 {
+		fmt.Fprintln(os.Stderr, colorize("Error: Expected exactly one Docker image reference", "red", false))
 		showUsage()
-		os.Exit(1)
+		return 1
 	}
 
-	imageRef := args[0]
+	imageRef := positional[0]
 
 	isTerm := isTerminal()
 	if verbose {
@@ -133,39 +244,49 @@ func main() {
 		noColor = true
 	}
 
-	if err := checkPrerequisites(fsType, dualOutput); err != nil {
+	if err := checkPrerequisites(opts.FsType, opts.DualOutput, opts.Stream); err != nil {
 		fmt.Fprintf(os.Stderr, "%s Error: Missing prerequisites - %v\n", colorize("❌", "red", noColor), err)
 		suggestPrerequisiteInstallation()
-		os.Exit(1)
+		return 1
 	}
 
-	outputFormat := fsType
-	if dualOutput {
-		outputFormat = fsType + "+squashfs"
+	outputFormat := opts.FsType
+	if opts.DualOutput {
+		outputFormat = opts.FsType + "+squashfs"
 	}
 
 	if !quiet {
 		fmt.Printf("%s Converting Docker image '%s' to %s filesystem...\n", colorize("🚀", "blue", noColor), imageRef, outputFormat)
 	}
 
-	outputPath, err := createFsFromImage(imageRef)
+	result, err := createFsFromImage(imageRef, opts)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s %v\n", colorize("❌ Fatal Error:", "red", noColor), err)
-		os.Exit(1)
+		return 1
 	}
 
 	if quiet {
-		fmt.Println(outputPath)
+		fmt.Println(result.Image)
 	} else {
-		fmt.Printf("\n%s Successfully created image: %s\n", colorize("✅", "green", noColor), outputPath)
+		fmt.Printf("\n%s Successfully created image: %s\n", colorize("✅", "green", noColor), result.Image)
 	}
+	return 0
 }
 
 func showUsage() {
 	fmt.Println(`fsify - Convert Docker images to bootable filesystem images
 
 USAGE:
-    sudo fsify [OPTIONS] <docker-image>
+    sudo fsify [convert] [OPTIONS] <docker-image>
+    fsify <command> [OPTIONS] [ARGS]
+
+COMMANDS:
+    convert     Convert an image to a filesystem image (default)
+    inspect     Show what a built image contains: fsify inspect [--json] <image>
+    verify      Check an image against its manifest: fsify verify [-m FILE] <image>
+    build       Build every image in a spec: fsify build [-f fsify.yaml] [-j N] [--report FILE]
+    cache       Manage the layer cache: fsify cache dir|list|prune|clean
+    version     Show version information
 
 EXAMPLES:
     sudo fsify nginx:latest                    # Basic usage (idiot path)
@@ -173,6 +294,10 @@ EXAMPLES:
     sudo fsify -o my-image.img ubuntu:22.04   # Custom output
     sudo fsify --preallocate -v nginx:latest  # Preallocated disk
     sudo fsify --dual-output redis:7.0        # Both ext4 + squashfs
+    sudo fsify --free-space 512M ubuntu:22.04  # Writable root with headroom
+    sudo fsify --stream -fs erofs nginx:latest # Stream layers, no mount
+    fsify inspect --json nginx-latest.img      # Show what an image contains
+    sudo fsify verify nginx-latest.img         # Check against nginx-latest.img.manifest.json
 
 OPTIONS:
     -h, --help            Show this help message
@@ -181,10 +306,71 @@ OPTIONS:
     -o, --output FILE     Output file path (default: <image-name>.img)
     -q, --quiet           Quiet mode (minimal output, just final path)
     --no-color            Disable colored output
-    -fs, --filesystem     Filesystem type (ext4, xfs, btrfs) (default: ext4)
-    -s, --size-buffer     Extra space in MB to add to the image (default: 50)
+    -fs, --filesystem T   Filesystem type (ext4, xfs, btrfs, erofs) (default: ext4)
+    -s, --size-buffer MB  Extra space in MB to add to the image (default: 50)
+    --size SIZE           Exact final image size, e.g. 2G (error if too small)
+    --free-space SIZE     Guaranteed free space after shrinking, e.g. 512M
+    --free-percent N      Guaranteed free space after shrinking, in percent
+    --min-inodes N        Minimum inode count in the final image
+    --label NAME          Filesystem label
+    --uuid UUID           Filesystem UUID (default: random)
+    --block-size BYTES    Filesystem block size
+    --inode-size BYTES    Inode size (ext4, xfs)
+    --inode-ratio BYTES   Bytes per inode (ext4; default: sized from the rootfs)
+    --ext4-features LIST  ext4 features, ^ to disable (e.g. ^metadata_csum)
+    --no-journal          Create ext4 without a journal (read-only roots)
+    --reserved-percent N  Percentage of ext4 blocks reserved for root
+    --xfs-reflink on|off  Enable or disable xfs reflink
+    --btrfs-compress ALG  Btrfs compression (zstd[:level], lzo, zlib[:level])
     --preallocate         Preallocate disk space instead of sparse allocation
     --dual-output         Generate both primary filesystem AND squashfs image
+    --sbom FORMAT         Write an SBOM next to the output (spdx-json, cyclonedx-json)
+    --sbom-embed          Also embed the SBOM in the image under /etc/fsify
+    --manifest            Write a per-file manifest (<output>.manifest.json) for verify
+    --verify-signature    Refuse images without a valid signature
+    --signature-key FILE  Cosign public key (PEM) to verify with; may be repeated
+    --signature-policy F  containers-policy.json to enforce while pulling
+    --require-digest      Reject references not pinned by digest (name@sha256:...)
+    --workdir DIR         Directory for intermediate files (default: $TMPDIR)
+    --keep-workdir        Keep intermediate files after the build, for debugging
+    --cache-dir DIR       Layer cache directory (default: ~/.cache/fsify)
+    --no-cache            Do not read or write the layer cache
+    --force               Overwrite existing output files
+    --output-dir DIR      Directory for the image and its sidecars
+    --name-template T     Output name, e.g. '{{.Repo}}-{{.Tag}}-{{.Arch}}.{{.Ext}}'
+                          Fields: Repo, Tag, Digest, Pinned, OS, Arch, Platform, FsType, Ext
+    -j, --jobs N          Parallel file copy workers (default: number of CPUs)
+    --stream              Stream merged layers into mkfs without unpacking or mounting
+                          (ext4 needs e2fsprogs >= 1.47.1 with libarchive; erofs needs erofs-utils)
+    --add SRC:DST[:MODE[:UID:GID]]
+                          Add a host file or directory to the rootfs; may be repeated
+    --add-tar FILE        Extract a tar (optionally gzipped) over the rootfs; may be repeated
+    --exclude PATTERN     Remove matching paths before sizing (/usr/share/doc/*, *.pyc); may be repeated
+    --exclude-from FILE   Read exclude patterns from a file, one per line
+    --slim                Remove package caches, docs, man pages and unused locales
+    --keep-locales LIST   Locales --slim keeps (default: en)
+    --hostname NAME       Write /etc/hostname and a matching /etc/hosts entry
+    --dns IP              Nameserver for /etc/resolv.conf; may be repeated
+    --fstab auto|none     Generate /etc/fstab with the root by label or UUID
+    --tmpfs PATH[:OPTS]   Add a tmpfs mount to the generated fstab; may be repeated
+    --cloud-init FILE     Write a NoCloud seed (<output>.cidata.img) with this user-data
+    --meta-data FILE      meta-data for the seed (default: instance-id from the image digest)
+    --network-config FILE network-config for the seed
+    --overlay IMAGE       Unpack another image over the base image; may be repeated, applied in order
+    --entrypoint-from IMAGE
+                          With --overlay, the image whose Entrypoint and Cmd are kept (default: the base)
+    --init systemd|none   Enable the generated fsify-app.service in the image's own systemd
+    --user NAME           Create a login user (if missing) that gets the SSH keys
+    --ssh-authorized-key FILE
+                          Public key file for authorized_keys of --user, or root; may be repeated
+    --root-password-hash HASH
+                          crypt(3) hash for root's password (mkpasswd -m sha-512)
+
+    Options may come before or after the image. Every long option can also be
+    set from the environment as FSIFY_<NAME>, e.g. FSIFY_FS=xfs,
+    FSIFY_CACHE_DIR=/var/cache/fsify or FSIFY_NO_JOURNAL=true; options on the
+    command line take precedence, and a repeatable option given on the
+    command line replaces its FSIFY_<NAME> value.
 
 REQUIREMENTS:
     - Root privileges (for mount/mkfs operations)
@@ -194,6 +380,8 @@ REQUIREMENTS:
     - Filesystem utilities (mkfs.<type>, mount, umount)
     - Optional: pv (for progress monitoring during copy)
     - Optional: mksquashfs (for --dual-output mode)
+    - Optional: mkfs.erofs (for --stream -fs erofs)
+    - Optional: debugfs, unsquashfs, dump.erofs (for inspect)
 
 FEATURES:
     - Cross-filesystem support with automatic flag detection
@@ -258,8 +446,19 @@ func isFileTerminal(f *os.File) bool {
 	return (fi.Mode() & os.ModeCharDevice) != 0
 }
 
+// rootfsPath is the unpacked root filesystem inside the umoci bundle.
+func (ctx *ConversionContext) rootfsPath() string {
+	return filepath.Join(ctx.UnpackedPath, "rootfs")
+}
+
 func (ctx *ConversionContext) runCommand(name string, args ...string) error {
+	return ctx.runCommandWithInput(nil, name, args...)
+}
+
+// runCommandWithInput runs a command like runCommand, feeding input to its stdin.
+func (ctx *ConversionContext) runCommandWithInput(input io.Reader, name string, args ...string) error {
 	cmd := exec.Command(name, args...)
+	cmd.Stdin = input
 
 	if ctx.Verbose {
 		fmt.Printf("%s Running: %s %s\n", colorize("│", "blue", ctx.NoColor), name, strings.Join(args, " "))
@@ -290,6 +489,30 @@ func (ctx *ConversionContext) runCommand(name string, args ...string) error {
 	return nil
 }
 
+// commandOutput runs a command and returns its stdout.
+func (ctx *ConversionContext) commandOutput(name string, args ...string) ([]byte, error) {
+	if ctx.Verbose {
+		fmt.Printf("%s Running: %s %s\n", colorize("│", "blue", ctx.NoColor), name, strings.Join(args, " "))
+	}
+	var stderr strings.Builder
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("command '%s %s' failed: %v\n--- Output ---\n%s", name, strings.Join(args, " "), err, stderr.String())
+	}
+	return out, nil
+}
+
+// removeWorkDir deletes the intermediate files unless --keep-workdir is set.
+func (ctx *ConversionContext) removeWorkDir() {
+	if ctx.KeepWorkDir {
+		fmt.Fprintf(os.Stderr, "%s Kept work directory %s\n", colorize("│", "yellow", ctx.NoColor), ctx.TempDir)
+		return
+	}
+	os.RemoveAll(ctx.TempDir)
+}
+
 func (ctx *ConversionContext) runStep(message string, task func() error) error {
 	if !ctx.Quiet && isTerminal() {
 		stopSpinner := make(chan struct{})
@@ -317,33 +540,209 @@ func (ctx *ConversionContext) runStep(message string, task func() error) error {
 	return task()
 }
 
-func createFsFromImage(imageRef string) (string, error) {
+// conversionStep is one stage of the conversion pipeline.
+type conversionStep struct {
+	message  string
+	icon     string
+	progress bool // Step draws its own progress bar instead of the spinner
+	task     func() error
+}
+
+// activeConversions counts conversions that still need cleanup on interrupt.
+var activeConversions sync.WaitGroup
+
+// conversionResult describes what a successful conversion produced.
+type conversionResult struct {
+	Image   string   `json:"image"`   // Absolute path of the primary image
+	Outputs []string `json:"outputs"` // Every file written, image first
+	Digest  string   `json:"digest"`  // Manifest digest the image was pulled by
+}
+
+func createFsFromImage(imageRef string, opts convertOptions) (*conversionResult, error) {
 	ctx := &ConversionContext{
-		ImageRef:    imageRef,
-		Verbose:     verbose,
-		Quiet:       quiet,
-		NoColor:     noColor,
-		FsType:      fsType,
-		BufferSize:  bufferSize,
-		Preallocate: preallocate,
-		DualOutput:  dualOutput,
+		ImageRef:     imageRef,
+		OutputFile:   opts.Output,
+		OutputDir:    opts.OutputDir,
+		NameTemplate: opts.NameTemplate,
+		Force:        opts.Force,
+		WorkDir:      opts.WorkDir,
+		KeepWorkDir:  opts.KeepWorkDir,
+		Verbose:      verbose,
+		Quiet:        quiet,
+		NoColor:      noColor,
+		FsType:       opts.FsType,
+		BufferSize:   opts.BufferMB,
+		Preallocate:  opts.Preallocate,
+		DualOutput:   opts.DualOutput,
+		Stream:       opts.Stream,
+		Jobs:         opts.CopyJobs,
+		FreePercent:  opts.FreePercent,
+		MinInodes:    opts.MinInodes,
+		StartTime:    time.Now(),
+		SBOMFormat:   opts.SBOM,
+		Signature:    signaturePolicy{Keys: opts.SignatureKeys, PolicyFile: opts.SignaturePolicy},
+		SBOMEmbed:    opts.SBOMEmbed,
+		FsOptions: fsOptions{
+			Label:      opts.Label,
+			UUID:       opts.UUID,
+			BlockSize:  opts.BlockSize,
+			InodeSize:  opts.InodeSize,
+			InodeRatio: opts.InodeRatio,
+			Ext4:       ext4Options{NoJournal: opts.NoJournal, ReservedPercent: opts.ReservedPercent},
+			XFS:        xfsOptions{Reflink: opts.XFSReflink},
+			Btrfs:      btrfsOptions{Compress: opts.BtrfsCompress},
+		},
+	}
+	ctx.RegistryManifests = make(map[string][]byte)
+	if !opts.NoCache {
+		ctx.Cache = &blobCache{dir: opts.CacheDir}
+	}
+	if opts.Ext4Features != "" {
+		ctx.FsOptions.Ext4.Features = strings.Split(opts.Ext4Features, ",")
+	}
+
+	if err := validateImageRef(imageRef, opts.RequireDigest); err != nil {
+		return nil, err
+	}
+	for _, ref := range opts.Overlay {
+		if err := validateImageRef(ref, opts.RequireDigest); err != nil {
+			return nil, fmt.Errorf("invalid --overlay: %w", err)
+		}
+		ctx.Overlays = append(ctx.Overlays, overlayImage{Ref: ref})
+	}
+	if opts.EntrypointFrom != "" && opts.EntrypointFrom != imageRef {
+		if !slices.Contains(opts.Overlay, opts.EntrypointFrom) {
+			return nil, fmt.Errorf("--entrypoint-from %q is neither the image nor one of the --overlay images", opts.EntrypointFrom)
+		}
+		ctx.EntrypointFrom = opts.EntrypointFrom
+	}
+	if ctx.OutputFile != "" && (ctx.OutputDir != "" || ctx.NameTemplate != "") {
+		return nil, fmt.Errorf("-o cannot be combined with --output-dir or --name-template")
+	}
+	if _, err := parseNameTemplate(ctx.NameTemplate); err != nil {
+		return nil, err
+	}
+	if ctx.OutputDir != "" {
+		if err := os.MkdirAll(ctx.OutputDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+
+	var err error
+	if opts.Size != "" {
+		if ctx.TargetSize, err = parseSize(opts.Size); err != nil {
+			return nil, err
+		}
+	}
+	if opts.FreeSpace != "" {
+		if ctx.FreeSpace, err = parseSize(opts.FreeSpace); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateSizeTargets(ctx); err != nil {
+		return nil, err
+	}
+	if err := ctx.FsOptions.validate(ctx.FsType); err != nil {
+		return nil, err
+	}
+	if opts.VerifySignature && !ctx.Signature.enabled() {
+		return nil, fmt.Errorf("--verify-signature needs --signature-key or --signature-policy")
+	}
+	if err := validateSBOMFormat(ctx.SBOMFormat); err != nil {
+		return nil, err
+	}
+	if ctx.SBOMEmbed && ctx.SBOMFormat == "" {
+		return nil, fmt.Errorf("--sbom-embed requires --sbom")
+	}
+	if ctx.Stream && ctx.SBOMFormat != "" {
+		return nil, fmt.Errorf("--sbom needs the unpacked rootfs and cannot be used with --stream")
+	}
+	if ctx.Stream && opts.Manifest {
+		return nil, fmt.Errorf("--manifest is recorded while copying and cannot be used with --stream")
+	}
+	if ctx.Guest, err = newGuestConfig(opts, &ctx.FsOptions); err != nil {
+		return nil, err
+	}
+	if opts.CloudInit != "" {
+		ctx.CloudInit = &cloudInitConfig{UserData: opts.CloudInit, MetaData: opts.MetaData, NetworkConfig: opts.NetworkConfig}
+		for _, file := range []string{opts.CloudInit, opts.MetaData, opts.NetworkConfig} {
+			if _, err := os.Stat(file); file != "" && err != nil {
+				return nil, fmt.Errorf("invalid cloud-init file: %w", err)
+			}
+		}
+	} else if opts.MetaData != "" || opts.NetworkConfig != "" {
+		return nil, fmt.Errorf("--meta-data and --network-config require --cloud-init")
+	}
+	if ctx.Access, err = newAccessConfig(opts); err != nil {
+		return nil, err
+	}
+	if ctx.Stream && ctx.Access != nil {
+		return nil, fmt.Errorf("--user, --ssh-authorized-key and --root-password-hash edit the unpacked rootfs and cannot be used with --stream")
+	}
+	switch opts.Init {
+	case "", "none":
+	case "systemd":
+		ctx.Init = opts.Init
+	default:
+		return nil, fmt.Errorf("invalid --init %q (use systemd or none)", opts.Init)
+	}
+	if ctx.Exclude, err = newExcluder(opts.Exclude, opts.ExcludeFrom, opts.Slim, opts.KeepLocales); err != nil {
+		return nil, err
+	}
+	for _, spec := range opts.Add {
+		add, err := parseAddition(spec)
+		if err != nil {
+			return nil, err
+		}
+		ctx.Additions = append(ctx.Additions, add)
+	}
+	for _, tarPath := range opts.AddTar {
+		if _, err := os.Stat(tarPath); err != nil {
+			return nil, fmt.Errorf("invalid --add-tar: %w", err)
+		}
+		abs, err := filepath.Abs(tarPath)
+		if err != nil {
+			return nil, err
+		}
+		ctx.AddTars = append(ctx.AddTars, abs)
+	}
+	if ctx.Stream && (len(ctx.Additions) > 0 || len(ctx.AddTars) > 0) {
+		return nil, fmt.Errorf("--add and --add-tar modify the unpacked rootfs and cannot be used with --stream")
 	}
 
-	tempDir, err := os.MkdirTemp("", "fsify-")
+	if ctx.WorkDir != "" {
+		if err := os.MkdirAll(ctx.WorkDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create work directory: %w", err)
+		}
+	}
+	tempDir, err := os.MkdirTemp(ctx.WorkDir, "fsify-")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	ctx.TempDir = tempDir
-	defer os.RemoveAll(tempDir)
+	defer ctx.removeWorkDir()
 
+	// Batch builds run several conversions at once; on interrupt each one
+	// cleans up and the process exits only after all of them have.
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	defer close(done)
+	activeConversions.Add(1)
 	go func() {
-		<-sigChan
-		fmt.Printf("\n%s Interrupt received, cleaning up...\n", colorize("⚠️", "yellow", ctx.NoColor))
-		_ = unmountImage(ctx)
-		os.RemoveAll(tempDir)
-		os.Exit(1)
+		defer signal.Stop(sigChan)
+		select {
+		case <-sigChan:
+			fmt.Printf("\n%s Interrupt received, cleaning up...\n", colorize("⚠️", "yellow", ctx.NoColor))
+			_ = unmountImage(ctx)
+			unstagePending()
+			ctx.removeWorkDir()
+			activeConversions.Done()
+			activeConversions.Wait()
+			os.Exit(1)
+		case <-done:
+			activeConversions.Done()
+		}
 	}()
 
 	ctx.OciLayoutPath = filepath.Join(tempDir, "oci-layout")
@@ -352,72 +751,137 @@ func createFsFromImage(imageRef string) (string, error) {
 	ctx.SquashfsPath = filepath.Join(tempDir, "fs-image.squashfs")
 	ctx.MountPoint = filepath.Join(tempDir, "mnt")
 
-	if outputFile == "" {
-		// Simplified output filename: nginx-latest.img
-		parts := strings.Split(imageRef, "/")
-		imagePart := parts[len(parts)-1]
-		ctx.FinalPath = imagePart + ".img"
-		if dualOutput {
-			ctx.FinalSquashfsPath = imagePart + ".squashfs"
-		}
-	} else {
-		ctx.FinalPath = outputFile
-		if dualOutput {
-			base := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
-			ctx.FinalSquashfsPath = base + ".squashfs"
-		}
+	ctx.ProvenancePath = filepath.Join(tempDir, "provenance.intoto.jsonl")
+	if ctx.SBOMFormat != "" {
+		ctx.SBOMPath = filepath.Join(tempDir, "sbom.json")
+	}
+	if opts.Manifest {
+		ctx.ManifestPath = filepath.Join(tempDir, "manifest.json")
+	}
+	if ctx.CloudInit != nil {
+		ctx.CloudInitPath = filepath.Join(tempDir, "cidata.img")
+	}
+
+	// Catch existing outputs before doing any work. Templates using the
+	// resolved digest or platform are checked again once those are known.
+	if err := resolveOutputPaths(ctx); err != nil {
+		return nil, err
+	}
+	if err := checkOutputsFree(ctx.finalOutputs(), ctx.Force); err != nil {
+		return nil, err
 	}
 
 	dirs := []string{ctx.OciLayoutPath, ctx.UnpackedPath, ctx.MountPoint}
-	if dualOutput {
+	if ctx.Stream {
+		// Nothing is unpacked or mounted in stream mode
+		dirs = []string{ctx.OciLayoutPath}
+		ctx.MountPoint = ""
+	}
+	if ctx.DualOutput {
 		dirs = append(dirs, filepath.Dir(ctx.SquashfsPath))
 	}
 	for _, dir := range dirs {
 		if err := os.Mkdir(dir, 0755); err != nil {
-			return "", fmt.Errorf("failed to create dir %s: %w", dir, err)
+			return nil, fmt.Errorf("failed to create dir %s: %w", dir, err)
 		}
 	}
 	defer unmountImage(ctx)
 
-	steps := []struct {
-		message string
-		icon    string
-		task    func() error
-	}{
-		{"Downloading OCI image", "📥", func() error { return downloadOciImage(ctx) }},
-		{"Unpacking image layers", "📦", func() error { return unpackOciImage(ctx) }},
-		{"Extracting OCI config", "📝", func() error { return extractOciConfig(ctx) }},
-		{"Calculating disk size", "📏", func() error { return createImageFile(ctx) }},
-		{"Creating filesystem", "💾", func() error { return createFilesystem(ctx) }},
-		{"Mounting image", "🔌", func() error { return mountImage(ctx) }},
-		{"Copying files to image", "📋", func() error { return copyRootfsToImage(ctx) }},
-		{"Unmounting image", "🔌", func() error { return unmountImage(ctx) }},
-		{"Shrinking to optimal size", "📦", func() error { return shrinkFilesystem(ctx) }},
-	}
-
-	if dualOutput {
-		steps = append(steps, struct {
-			message string
-			icon    string
-			task    func() error
-		}{"Creating squashfs image", "🗜️", func() error { return createSquashfsImage(ctx) }})
+	var steps []conversionStep
+	if ctx.Stream {
+		steps = []conversionStep{
+			{"Checking disk space", "💽", false, func() error { return checkDiskSpace(ctx) }},
+			{"Downloading OCI image", "📥", false, func() error { return downloadOciImage(ctx) }},
+		}
+		if len(ctx.Overlays) > 0 {
+			steps = append(steps, conversionStep{"Downloading overlay images", "📥", false, func() error { return downloadOverlayImages(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Merging image layers", "📦", false, func() error { return mergeOciLayers(ctx) }})
+		if ctx.Exclude != nil {
+			steps = append(steps, conversionStep{"Pruning excluded paths", "🧹", false, func() error { return pruneRootfs(ctx) }})
+		}
+		steps = append(steps, []conversionStep{
+			{"Configuring guest system", "🖥️", false, func() error { return configureGuest(ctx) }},
+			{"Extracting OCI config", "📝", false, func() error { return extractOciConfig(ctx) }},
+			{"Translating image config", "⚙️", false, func() error { return translateImageConfig(ctx) }},
+		}...)
+		if ctx.Init == "systemd" {
+			steps = append(steps, conversionStep{"Enabling systemd service", "🚀", false, func() error { return enableSystemdInit(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Recording build info", "📝", false, func() error { return writeBuildInfo(ctx) }})
+		if ctx.FsType == "ext4" {
+			steps = append(steps, conversionStep{"Calculating disk size", "📏", false, func() error { return createImageFile(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Streaming layers into filesystem", "📋", true, func() error { return streamLayersToFilesystem(ctx) }})
+		if ctx.FsType == "ext4" {
+			steps = append(steps, conversionStep{"Shrinking to optimal size", "📦", false, func() error { return shrinkFilesystem(ctx) }})
+		}
+		if ctx.DualOutput {
+			steps = append(steps, conversionStep{"Creating squashfs image", "🗜️", false, func() error { return streamSquashfsImage(ctx) }})
+		}
+	} else {
+		steps = []conversionStep{
+			{"Checking disk space", "💽", false, func() error { return checkDiskSpace(ctx) }},
+			{"Downloading OCI image", "📥", false, func() error { return downloadOciImage(ctx) }},
+		}
+		if len(ctx.Overlays) > 0 {
+			steps = append(steps, conversionStep{"Downloading overlay images", "📥", false, func() error { return downloadOverlayImages(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Unpacking image layers", "📦", false, func() error { return unpackOciImage(ctx) }})
+		if len(ctx.Overlays) > 0 {
+			steps = append(steps, conversionStep{"Applying overlay images", "📚", false, func() error { return applyOverlayImages(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Extracting OCI config", "📝", false, func() error { return extractOciConfig(ctx) }})
+		if ctx.Exclude != nil {
+			steps = append(steps, conversionStep{"Pruning excluded paths", "🧹", false, func() error { return pruneRootfs(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Configuring guest system", "🖥️", false, func() error { return configureGuest(ctx) }})
+		if ctx.Access != nil {
+			steps = append(steps, conversionStep{"Provisioning login access", "🔑", false, func() error { return provisionAccess(ctx) }})
+		}
+		if len(ctx.Additions) > 0 || len(ctx.AddTars) > 0 {
+			steps = append(steps, conversionStep{"Adding files to rootfs", "📎", false, func() error { return addFilesToRootfs(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Translating image config", "⚙️", false, func() error { return translateImageConfig(ctx) }})
+		if ctx.Init == "systemd" {
+			steps = append(steps, conversionStep{"Enabling systemd service", "🚀", false, func() error { return enableSystemdInit(ctx) }})
+		}
+		steps = append(steps, conversionStep{"Recording build info", "📝", false, func() error { return writeBuildInfo(ctx) }})
+		if ctx.SBOMFormat != "" {
+			steps = append(steps, conversionStep{"Generating SBOM", "🧾", false, func() error { return generateSBOM(ctx) }})
+		}
+		steps = append(steps, []conversionStep{
+			{"Calculating disk size", "📏", false, func() error { return createImageFile(ctx) }},
+			{"Creating filesystem", "💾", false, func() error { return createFilesystem(ctx) }},
+			{"Mounting image", "🔌", false, func() error { return mountImage(ctx) }},
+			{"Copying files to image", "📋", true, func() error { return copyRootfsToImage(ctx) }},
+			{"Unmounting image", "🔌", false, func() error { return unmountImage(ctx) }},
+			{"Shrinking to optimal size", "📦", false, func() error { return shrinkFilesystem(ctx) }},
+		}...)
+		if ctx.DualOutput {
+			steps = append(steps, conversionStep{"Creating squashfs image", "🗜️", false, func() error { return createSquashfsImage(ctx) }})
+		}
+	}
+
+	if ctx.CloudInit != nil {
+		steps = append(steps, conversionStep{"Creating cloud-init seed", "🌱", false, func() error { return buildCloudInitSeed(ctx) }})
 	}
 
 	for _, step := range steps {
-		// Special handling for copy step - it has its own progress bar
-		if step.message == "Copying files to image" {
+		// Steps with their own progress bar don't use the spinner
+		if step.progress {
 			if !ctx.Quiet {
-				icon := "Copying files"
-				if !ctx.NoColor && isTerminal() {
-					icon = "📋"
+				icon := step.icon
+				if ctx.NoColor || !isTerminal() {
+					icon = "-"
 				}
-				fmt.Printf("%s files to image...\n", icon)
+				fmt.Printf("%s %s...\n", icon, step.message)
 			}
 			if err := step.task(); err != nil {
 				if !ctx.Quiet {
 					fmt.Printf("\r%s %s ... Failed\n", "❌", step.message)
 				}
-				return "", fmt.Errorf("step '%s' failed: %w", step.message, err)
+				return nil, fmt.Errorf("step '%s' failed: %w", step.message, err)
 			}
 			if !ctx.Quiet {
 				fmt.Printf("\r%s %s ... Done\n", "✅", step.message)
@@ -428,7 +892,7 @@ func createFsFromImage(imageRef string) (string, error) {
 				if !ctx.Quiet {
 					fmt.Printf("\r%s %s ... Failed\n", "❌", step.message)
 				}
-				return "", fmt.Errorf("step '%s' failed: %w", step.message, err)
+				return nil, fmt.Errorf("step '%s' failed: %w", step.message, err)
 			}
 			if !ctx.Quiet {
 				fmt.Printf("\r%s %s ... Done\n", step.icon, step.message)
@@ -436,31 +900,78 @@ func createFsFromImage(imageRef string) (string, error) {
 		}
 	}
 
+	if err := resolveOutputPaths(ctx); err != nil {
+		return nil, err
+	}
+	outputs := ctx.finalOutputs()
+	if err := checkOutputsFree(outputs, ctx.Force); err != nil {
+		return nil, err
+	}
+	if err := writeProvenance(ctx); err != nil {
+		return nil, err
+	}
+
 	if !ctx.Quiet {
 		fmt.Printf("%s Moving final image...", colorize("🚚", "yellow", ctx.NoColor))
 	}
-	if err := os.Rename(ctx.ImagePath, ctx.FinalPath); err != nil {
-		return "", fmt.Errorf("failed to move final image to %s: %w", ctx.FinalPath, err)
+	if err := finalizeOutputs(ctx); err != nil {
+		if !ctx.Quiet {
+			fmt.Println()
+		}
+		return nil, err
 	}
 	if !ctx.Quiet {
 		fmt.Printf("\r%s Moved final image to %s\n", colorize("🚚", "green", ctx.NoColor), ctx.FinalPath)
+		for _, out := range outputs[1:] {
+			fmt.Printf("%s Wrote %s: %s\n", colorize("│", "cyan", ctx.NoColor), out.label, out.dest)
+		}
 	}
 
-	if dualOutput {
-		if err := os.Rename(ctx.SquashfsPath, ctx.FinalSquashfsPath); err != nil {
-			return "", fmt.Errorf("failed to move squashfs image to %s: %w", ctx.FinalSquashfsPath, err)
+	if !ctx.Quiet && ctx.Runtime != nil {
+		for _, warning := range ctx.Runtime.Warnings {
+			fmt.Printf("%s %s\n", colorize("⚠️", "yellow", ctx.NoColor), warning)
 		}
-		if !ctx.Quiet {
-			fmt.Printf("%s Created squashfs image: %s\n", colorize("🗜️", "green", ctx.NoColor), ctx.FinalSquashfsPath)
+	}
+	if !ctx.Quiet && ctx.Exclude != nil {
+		fmt.Printf("%s Excluded %d paths, saved %s\n", colorize("🧹", "green", ctx.NoColor), ctx.PrunedPaths, formatBytes(ctx.PrunedBytes))
+	}
+	if !ctx.Quiet {
+		if ctx.ImageDigest != "" {
+			repo, _, _ := splitImageRef(ctx.ImageRef)
+			fmt.Printf("%s Source: %s@%s\n", colorize("📌", "green", ctx.NoColor), repo, ctx.ImageDigest)
+		} else {
+			fmt.Printf("%s Source: %s from the local Docker daemon (local manifest %s)\n", colorize("📌", "green", ctx.NoColor), ctx.ImageRef, ctx.LocalDigest)
+		}
+		for _, overlay := range ctx.Overlays {
+			repo, _, _ := splitImageRef(overlay.Ref)
+			fmt.Printf("%s Overlay: %s@%s\n", colorize("📌", "green", ctx.NoColor), repo, overlay.Digest)
 		}
 	}
 
-	// Always return the primary (bootable) image path
-	return filepath.Abs(ctx.FinalPath)
+	// Always report the primary (bootable) image path first
+	result := &conversionResult{Digest: ctx.ImageDigest}
+	for _, out := range outputs {
+		path, err := filepath.Abs(out.dest)
+		if err != nil {
+			return nil, err
+		}
+		result.Outputs = append(result.Outputs, path)
+	}
+	result.Image = result.Outputs[0]
+	return result, nil
 }
 
-func checkPrerequisites(fs string, checkSquashfs bool) error {
+func checkPrerequisites(fs string, checkSquashfs bool, stream bool) error {
 	tools := []string{"skopeo", "umoci", "mount", "umount", "dd", "du", "cp", "mkfs." + fs, "e2fsck", "resize2fs", "dumpe2fs"}
+	if stream {
+		if fs != "ext4" && fs != "erofs" {
+			return fmt.Errorf("streaming mode supports only ext4 and erofs, not %s", fs)
+		}
+		tools = []string{"skopeo", "dd", "mkfs." + fs}
+		if fs == "ext4" {
+			tools = append(tools, "e2fsck", "resize2fs", "dumpe2fs")
+		}
+	}
 	if checkSquashfs {
 		tools = append(tools, "mksquashfs")
 	}
@@ -486,20 +997,52 @@ func suggestPrerequisiteInstallation() {
 }
 
 func downloadOciImage(ctx *ConversionContext) error {
-	// Try local Docker daemon first
-	localErr := ctx.runCommand("skopeo", "copy", fmt.Sprintf("docker-daemon:%s", ctx.ImageRef), fmt.Sprintf("oci:%s:latest", ctx.OciLayoutPath))
-	if localErr == nil {
+	// Signatures live in the registry, so the local daemon is never used for signed pulls
+	if ctx.Signature.enabled() {
+		return downloadSignedImage(ctx)
+	}
+
+	// Try local Docker daemon first; it cannot look images up by digest
+	repo, _, pinned := splitImageRef(ctx.ImageRef)
+	if pinned == "" {
+		localErr := ctx.runCommand("skopeo", "copy", fmt.Sprintf("docker-daemon:%s", ctx.ImageRef), fmt.Sprintf("oci:%s:latest", ctx.OciLayoutPath))
+		if localErr == nil {
+			// The daemon has no registry manifest; the one skopeo wrote is
+			// kept apart so it is never reported as a pullable digest
+			index, err := loadOciIndex(ctx.OciLayoutPath)
+			if err != nil {
+				return err
+			}
+			ctx.LocalDigest = index.Manifests[0].Digest
+			if ctx.Verbose {
+				fmt.Printf("%s Successfully copied from local Docker daemon (%s)\n", colorize("│", "cyan", ctx.NoColor), ctx.LocalDigest)
+			}
+			return nil
+		}
+
+		// If local copy fails, try remote registry
 		if ctx.Verbose {
-			fmt.Printf("%s Successfully copied from local Docker daemon\n", colorize("│", "cyan", ctx.NoColor))
+			fmt.Printf("%s Local Docker daemon copy failed, trying remote registry...\n", colorize("│", "yellow", ctx.NoColor))
 		}
-		return nil
 	}
 
-	// If local copy fails, try remote registry
+	// Resolve the tag once and pull by digest, so the tag cannot move in between
+	digest, err := resolveRegistryDigest(ctx)
+	if err != nil {
+		return err
+	}
 	if ctx.Verbose {
-		fmt.Printf("%s Local Docker daemon copy failed, trying remote registry...\n", colorize("│", "yellow", ctx.NoColor))
+		fmt.Printf("%s Resolved %s to %s\n", colorize("│", "cyan", ctx.NoColor), ctx.ImageRef, digest)
 	}
-	return ctx.runCommand("skopeo", "copy", fmt.Sprintf("docker://%s", ctx.ImageRef), fmt.Sprintf("oci:%s:latest", ctx.OciLayoutPath))
+	src := fmt.Sprintf("%s@%s", repo, digest)
+	err = pullWithCache(ctx, src, func() error {
+		return ctx.runCommand("skopeo", "copy", "docker://"+src, fmt.Sprintf("oci:%s:latest", ctx.OciLayoutPath))
+	})
+	if err != nil {
+		return err
+	}
+	ctx.ImageDigest = digest
+	return nil
 }
 
 func unpackOciImage(ctx *ConversionContext) error {
@@ -507,27 +1050,34 @@ func unpackOciImage(ctx *ConversionContext) error {
 }
 
 func createImageFile(ctx *ConversionContext) error {
-	cmd := exec.Command("du", "-sk", ctx.UnpackedPath)
-	output, err := cmd.Output()
+	est, err := estimateImageSize(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get directory size: %w", err)
-	}
-	parts := strings.Fields(string(output))
-	if len(parts) < 1 {
-		return fmt.Errorf("failed to parse du output: %q", string(output))
+		return err
 	}
-	sizeKB, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return fmt.Errorf("failed to parse size %q: %w", parts[0], err)
+	if ctx.MinInodes > est.Inodes {
+		est.Inodes = ctx.MinInodes
 	}
+	sizeKB := int(est.TotalBytes / 1024)
 
-	// Use a generous buffer - we'll shrink to optimal size later
+	// Add the user buffer on top - we'll shrink to optimal size later
 	bufferKB := ctx.BufferSize * 1024
 	totalSizeKB := sizeKB + bufferKB
+
+	switch {
+	case ctx.TargetSize > 0:
+		if est.TotalBytes > ctx.TargetSize {
+			return fmt.Errorf("image needs at least %s but --size is %s", formatBytes(est.TotalBytes), formatBytes(ctx.TargetSize))
+		}
+		bufferKB = 0
+		totalSizeKB = int(ctx.TargetSize / 1024)
+	case ctx.FsType != "ext4":
+		// Without a shrink/grow pass the free-space target must be built in now
+		totalSizeKB = max(totalSizeKB, int(ctx.withFreeSpace(est.TotalBytes)/1024))
+	}
 	totalSizeBytes := totalSizeKB * 1024
 
 	if ctx.Verbose {
-		fmt.Printf("%s Rootfs: %d KB, Buffer: %d KB, Total: %d KB\n", colorize("│", "blue", ctx.NoColor), sizeKB, bufferKB, totalSizeKB)
+		fmt.Printf("%s Estimated: %d KB, Buffer: %d KB, Total: %d KB\n", colorize("│", "blue", ctx.NoColor), sizeKB, bufferKB, totalSizeKB)
 	}
 
 	if ctx.Preallocate {
@@ -550,10 +1100,16 @@ func createFilesystem(ctx *ConversionContext) error {
 		"btrfs": {"-f"},
 	}
 
+	args = append(ctx.FsOptions.mkfsArgs(ctx.FsType), args...)
 	if flags, exists := mkfsFlags[ctx.FsType]; exists {
 		args = append(flags, args...)
 	}
 
+	// ext4 fixes its inode count at mkfs time; size it for the tree unless a ratio was given
+	if ctx.FsType == "ext4" && ctx.Estimate != nil && ctx.FsOptions.InodeRatio == 0 {
+		args = append([]string{"-N", strconv.FormatInt(ctx.Estimate.Inodes, 10)}, args...)
+	}
+
 	err := ctx.runCommand(mkfsCmd, args...)
 	if err != nil {
 		// Provide helpful hints for common filesystem errors
@@ -586,39 +1142,24 @@ func mountImage(ctx *ConversionContext) error {
 	}
 
 	// Now mount the specific loop device
-	return ctx.runCommand("mount", ctx.LoopDevicePath, ctx.MountPoint)
-}
-
-func copyRootfsToImage(ctx *ConversionContext) error {
-	// --- Step 1: Calculate total size for the progress bar ---
-	var totalSize int64
-	err := filepath.WalkDir(ctx.UnpackedPath, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !d.IsDir() {
-			info, err := d.Info()
-			if err != nil {
-				return err
-			}
-			totalSize += info.Size()
-		}
-		return nil
-	})
-	if err != nil {
-		return fmt.Errorf("failed to calculate total size of rootfs: %w", err)
+	mountArgs := append(ctx.FsOptions.mountOptions(ctx.FsType), ctx.LoopDevicePath, ctx.MountPoint)
+	if err := ctx.runCommand("mount", mountArgs...); err != nil {
+		return err
 	}
+	return applyMountedDefaults(ctx)
+}
 
-	// --- Step 2: Set up the progress bar ---
+// newCopyProgressBar creates the byte progress bar shared by the copy and stream steps.
+func newCopyProgressBar(ctx *ConversionContext, totalSize int64, description string) *progressbar.ProgressBar {
 	// Use plain text when colors are disabled
-	description := "Copying files to image"
 	if !ctx.NoColor && isTerminal() {
-		description = "📋 Copying files to image"
+		description = "📋 " + description
 	}
 
-	bar := progressbar.NewOptions64(totalSize,
+	return progressbar.NewOptions64(totalSize,
 		progressbar.OptionSetDescription(description),
 		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionSetVisibility(!ctx.Quiet),
 		progressbar.OptionShowBytes(true),
 		progressbar.OptionSetWidth(15),
 		progressbar.OptionThrottle(65*time.Millisecond),
@@ -626,125 +1167,46 @@ func copyRootfsToImage(ctx *ConversionContext) error {
 		progressbar.OptionSpinnerType(14),
 		progressbar.OptionFullWidth(),
 		progressbar.OptionSetTheme(progressbar.Theme{
-			Saucer:        "=",  // Plain text
+			Saucer:        "=", // Plain text
 			SaucerHead:    ">",
 			SaucerPadding: " ",
 			BarStart:      "[",
 			BarEnd:        "]",
 		}),
 	)
-
-	// --- Step 3: Walk and copy, updating the bar ---
-	// Walk the actual rootfs subdirectory, not the unpacked parent
-	actualRootfs := filepath.Join(ctx.UnpackedPath, "rootfs")
-	return filepath.WalkDir(actualRootfs, func(srcPath string, d os.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Get the relative path to reconstruct the destination
-		relPath, err := filepath.Rel(actualRootfs, srcPath)
-		if err != nil {
-			return err
-		}
-		destPath := filepath.Join(ctx.MountPoint, relPath)
-
-		// Get file info to double-check type
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("failed to get info for %s: %w", srcPath, err)
-		}
-
-		if info.IsDir() {
-			return os.MkdirAll(destPath, 0755)
-		}
-
-		// It's a file, so copy it
-		if info.Mode()&os.ModeSymlink != 0 {
-			// Handle symlinks
-			target, err := os.Readlink(srcPath)
-			if err != nil {
-				return fmt.Errorf("failed to read symlink %s: %w", srcPath, err)
-			}
-			return os.Symlink(target, destPath)
-		}
-
-		// Regular file
-		srcFile, err := os.Open(srcPath)
-		if err != nil {
-			return fmt.Errorf("failed to open source file %s: %w", srcPath, err)
-		}
-		defer srcFile.Close()
-
-		// Preserve file permissions
-		destFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
-		if err != nil {
-			return fmt.Errorf("failed to create destination file %s: %w", destPath, err)
-		}
-		defer destFile.Close()
-
-		// Create a multi-writer that writes to the destination file AND the progress bar
-		writer := io.MultiWriter(destFile, bar)
-
-		_, err = io.Copy(writer, srcFile)
-		return err
-	})
 }
 
 func extractOciConfig(ctx *ConversionContext) error {
-	// Find the config.json file in the OCI layout
-	configPath := filepath.Join(ctx.OciLayoutPath, "blobs", "sha256")
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		return nil // Skip if no config available
-	}
-
-	// Read the index.json to find the config file
-	indexPath := filepath.Join(ctx.OciLayoutPath, "index.json")
-	indexData, err := os.ReadFile(indexPath)
+	_, config, err := loadOciConfig(ctx.OciLayoutPath)
 	if err != nil {
-		return nil // Skip if can't read index
-	}
-
-	// Parse the JSON properly
-	var index OCIIndex
-	if err := json.Unmarshal(indexData, &index); err != nil {
-		return nil // Skip if can't parse JSON
-	}
-
-	if len(index.Manifests) == 0 {
-		return nil // No manifests found
-	}
-
-	configDigest := index.Manifests[0].Config.Digest
-	if configDigest == "" {
-		return nil // No config digest found
+		return nil // Skip if no config available
 	}
-
-	// Copy the config file to the rootfs
-	if strings.HasPrefix(configDigest, "sha256:") {
-		configDigest = strings.TrimPrefix(configDigest, "sha256:")
-		sourceConfig := filepath.Join(configPath, configDigest)
-		if _, err := os.Stat(sourceConfig); err == nil {
-			// Create /etc/fsify-entrypoint in the rootfs
-			entrypointDir := filepath.Join(ctx.UnpackedPath, "etc")
-			if err := os.MkdirAll(entrypointDir, 0755); err != nil {
-				return fmt.Errorf("failed to create /etc directory: %w", err)
-			}
-
-			// Copy the config file as entrypoint info
-			entrypointFile := filepath.Join(entrypointDir, "fsify-entrypoint")
-			return ctx.runCommand("cp", sourceConfig, entrypointFile)
+	if len(ctx.Overlays) > 0 {
+		if config, err = mergeImageConfigs(ctx, config); err != nil {
+			return err
 		}
 	}
+	if ctx.ImageConfig, err = parseOciConfig(config); err != nil && ctx.Verbose {
+		fmt.Printf("%s %v\n", colorize("│", "yellow", ctx.NoColor), err)
+	}
 
-	return nil
+	// Copy the config file as entrypoint info to /etc/fsify-entrypoint in the rootfs
+	return writeRootfsFile(ctx, "etc/fsify-entrypoint", config, 0644)
 }
 
 func createSquashfsImage(ctx *ConversionContext) error {
-	return ctx.runCommand("mksquashfs", ctx.UnpackedPath, ctx.SquashfsPath, "-noappend")
+	return ctx.runCommand("mksquashfs", ctx.rootfsPath(), ctx.SquashfsPath, "-noappend")
 }
 
 func shrinkFilesystem(ctx *ConversionContext) error {
+	// Only ext2/3/4 can be shrunk offline; other filesystems keep their estimated size
+	if ctx.FsType != "ext4" {
+		if ctx.Verbose {
+			fmt.Printf("%s %s cannot be shrunk offline, keeping the allocated size\n", colorize("│", "cyan", ctx.NoColor), ctx.FsType)
+		}
+		return nil
+	}
+
 	// Run e2fsck first (required before resize2fs)
 	if err := ctx.runCommand("e2fsck", "-f", "-y", ctx.ImagePath); err != nil {
 		// e2fsck may return non-zero even on success, check if it's a fatal error
@@ -753,35 +1215,42 @@ func shrinkFilesystem(ctx *ConversionContext) error {
 		}
 	}
 
+	// An exact --size image is already final
+	if ctx.TargetSize > 0 {
+		return nil
+	}
+
 	// Shrink the filesystem to minimum size
 	if err := ctx.runCommand("resize2fs", "-M", ctx.ImagePath); err != nil {
 		return fmt.Errorf("failed to shrink filesystem: %w", err)
 	}
 
 	// Get the new filesystem size
-	cmd := exec.Command("dumpe2fs", "-h", ctx.ImagePath)
-	output, err := cmd.Output()
+	info, err := readExt4Info(ctx.ImagePath)
 	if err != nil {
-		return fmt.Errorf("failed to get filesystem info: %w", err)
+		return err
 	}
 
-	// Parse block count and block size
-	var blockCount, blockSize int64
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.HasPrefix(line, "Block count:") {
-			fmt.Sscanf(line, "Block count: %d", &blockCount)
-		} else if strings.HasPrefix(line, "Block size:") {
-			fmt.Sscanf(line, "Block size: %d", &blockSize)
+	// Grow back to honor --free-space/--free-percent/--min-inodes. New groups
+	// carry their own metadata, so re-check until the target actually holds.
+	for i := 0; i < 3; i++ {
+		target := ctx.ext4TargetBlocks(info)
+		if target <= info.BlockCount {
+			break
+		}
+		if err := os.Truncate(ctx.ImagePath, target*info.BlockSize); err != nil {
+			return fmt.Errorf("failed to extend image file: %w", err)
+		}
+		if err := ctx.runCommand("resize2fs", ctx.ImagePath, strconv.FormatInt(target, 10)); err != nil {
+			return fmt.Errorf("failed to grow filesystem: %w", err)
+		}
+		if info, err = readExt4Info(ctx.ImagePath); err != nil {
+			return err
 		}
-	}
-
-	if blockCount == 0 || blockSize == 0 {
-		return fmt.Errorf("failed to parse filesystem size from dumpe2fs")
 	}
 
 	// Calculate actual filesystem size in bytes
-	fsSize := blockCount * blockSize
+	fsSize := info.BlockCount * info.BlockSize
 
 	// Truncate the image file to match the filesystem size
 	if err := os.Truncate(ctx.ImagePath, fsSize); err != nil {
@@ -790,7 +1259,12 @@ func shrinkFilesystem(ctx *ConversionContext) error {
 
 	if ctx.Verbose {
 		sizeMB := float64(fsSize) / (1024 * 1024)
-		fmt.Printf("%s Shrunk image to %.2f MB\n", colorize("│", "green", ctx.NoColor), sizeMB)
+		fmt.Printf("%s Shrunk image to %.2f MB (%s free, %d free inodes)\n", colorize("│", "green", ctx.NoColor), sizeMB,
+			formatBytes(info.FreeBlocks*info.BlockSize), info.FreeInodes)
+		if ctx.Estimate != nil {
+			fmt.Printf("%s Estimate vs actual: %s vs %s, %d vs %d inodes used\n", colorize("│", "blue", ctx.NoColor),
+				formatBytes(ctx.Estimate.TotalBytes), formatBytes(fsSize), ctx.Estimate.Inodes, info.InodeCount-info.FreeInodes)
+		}
 	}
 
 	return nil
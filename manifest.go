@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// manifestSuffix is appended to the primary output path for the sidecar.
+const manifestSuffix = ".manifest.json"
+
+// fileManifest lists every path copied into an image, so the image can later
+// be checked against the rootfs it was built from.
+type fileManifest struct {
+	Source  string          `json:"source"`
+	Digest  string          `json:"digest,omitempty"`
+	Entries []manifestEntry `json:"entries"`
+}
+
+type manifestEntry struct {
+	Path   string `json:"path"` // Absolute path inside the image
+	Type   string `json:"type"` // file, dir, symlink, char, block or fifo
+	Mode   string `json:"mode"` // Octal permission bits, including setuid/setgid/sticky
+	Uid    uint32 `json:"uid"`
+	Gid    uint32 `json:"gid"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Target string `json:"target,omitempty"` // Symlink target
+	Rdev   string `json:"rdev,omitempty"`   // major:minor for device nodes
+}
+
+// newManifestEntry describes one path from its lstat info. File contents are
+// hashed separately. Sockets are not copied and return ok=false.
+func newManifestEntry(root, path string, info os.FileInfo) (manifestEntry, bool, error) {
+	relPath, err := filepath.Rel(root, path)
+	if err != nil {
+		return manifestEntry{}, false, err
+	}
+	entry := manifestEntry{Path: "/" + cleanTarPath(relPath)}
+	if relPath == "." {
+		entry.Path = "/"
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return manifestEntry{}, false, fmt.Errorf("no stat information for %s", path)
+	}
+	entry.Mode = fmt.Sprintf("%04o", st.Mode&07777)
+	entry.Uid, entry.Gid = st.Uid, st.Gid
+
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		entry.Type = "dir"
+	case mode&os.ModeSymlink != 0:
+		entry.Type = "symlink"
+		if entry.Target, err = os.Readlink(path); err != nil {
+			return manifestEntry{}, false, err
+		}
+	case mode.IsRegular():
+		entry.Type = "file"
+		entry.Size = info.Size()
+	case mode&os.ModeSocket != 0:
+		return manifestEntry{}, false, nil
+	case mode&os.ModeNamedPipe != 0:
+		entry.Type = "fifo"
+	case mode&os.ModeCharDevice != 0:
+		entry.Type = "char"
+		entry.Rdev = fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	default:
+		entry.Type = "block"
+		entry.Rdev = fmt.Sprintf("%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	}
+	return entry, true, nil
+}
+
+// writeManifest saves the manifest collected during the copy.
+func writeManifest(ctx *ConversionContext, entries []manifestEntry) error {
+	m := fileManifest{Source: ctx.ImageRef, Entries: entries}
+	if ctx.BuildInfo != nil {
+		m.Digest = ctx.BuildInfo.Digest
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := os.WriteFile(ctx.ManifestPath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// collectManifest walks root and hashes every regular file with a pool of workers.
+func collectManifest(root string, workers int) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry, ok, err := newManifestEntry(root, path, info)
+		if err != nil || !ok {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	queue := make(chan int)
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		hashErr error
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range queue {
+				sum, err := sha256File(filepath.Join(root, entries[idx].Path))
+				if err != nil {
+					errOnce.Do(func() { hashErr = err })
+					continue
+				}
+				entries[idx].SHA256 = sum
+			}
+		}()
+	}
+	for idx := range entries {
+		if entries[idx].Type == "file" {
+			queue <- idx
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return entries, hashErr
+}
+
+// compareManifest reports every difference between the expected manifest and
+// what was found in the image.
+func compareManifest(expected, actual []manifestEntry) []string {
+	found := make(map[string]manifestEntry, len(actual))
+	for _, entry := range actual {
+		found[entry.Path] = entry
+	}
+
+	var problems []string
+	for _, want := range expected {
+		got, ok := found[want.Path]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("missing: %s", want.Path))
+			continue
+		}
+		delete(found, want.Path)
+
+		var diffs []string
+		check := func(field, want, got string) {
+			if want != got {
+				diffs = append(diffs, fmt.Sprintf("%s %s != %s", field, got, want))
+			}
+		}
+		check("type", want.Type, got.Type)
+		check("mode", want.Mode, got.Mode)
+		check("uid", strconv.FormatUint(uint64(want.Uid), 10), strconv.FormatUint(uint64(got.Uid), 10))
+		check("gid", strconv.FormatUint(uint64(want.Gid), 10), strconv.FormatUint(uint64(got.Gid), 10))
+		check("size", strconv.FormatInt(want.Size, 10), strconv.FormatInt(got.Size, 10))
+		check("sha256", want.SHA256, got.SHA256)
+		check("target", want.Target, got.Target)
+		check("rdev", want.Rdev, got.Rdev)
+		if len(diffs) > 0 {
+			problems = append(problems, fmt.Sprintf("changed: %s (%s)", want.Path, strings.Join(diffs, ", ")))
+		}
+	}
+
+	var extra []string
+	for path := range found {
+		// Created by mkfs, never part of the rootfs
+		if path == "/lost+found" || strings.HasPrefix(path, "/lost+found/") {
+			continue
+		}
+		extra = append(extra, path)
+	}
+	sort.Strings(extra)
+	for _, path := range extra {
+		problems = append(problems, fmt.Sprintf("unexpected: %s", path))
+	}
+	return problems
+}
+
+// runVerify implements `fsify verify <image> [--manifest m.json]`.
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	manifestPath := fs.String("manifest", "", "Manifest to check against (default: <image>.manifest.json)")
+	fs.BoolVar(&noColor, "no-color", false, "Disable colored output")
+	aliasFlag(fs, "manifest", "m")
+	fs.Usage = func() {
+		fmt.Println("USAGE:\n    sudo fsify verify [-m|--manifest <manifest.json>] <image>")
+	}
+	positional := parseArgs(fs, args)
+	if len(positional) != 1 {
+		fs.Usage()
+		return 1
+	}
+	imagePath := positional[0]
+	if *manifestPath == "" {
+		*manifestPath = imagePath + manifestSuffix
+	}
+
+	problems, total, err := verifyImage(imagePath, *manifestPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", colorize("❌ Error:", "red", noColor), err)
+		return 1
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s %s\n", colorize("│", "red", noColor), problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s %s does not match %s: %d differences across %d entries\n",
+			colorize("❌", "red", noColor), imagePath, *manifestPath, len(problems), total)
+		return 1
+	}
+	fmt.Printf("%s %s matches %s (%d entries)\n", colorize("✅", "green", noColor), imagePath, *manifestPath, total)
+	return 0
+}
+
+// verifyImage mounts the image read-only and compares it with the manifest.
+func verifyImage(imagePath, manifestPath string) ([]string, int, error) {
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest fileManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, 0, fmt.Errorf("failed to parse manifest %s: %w", manifestPath, err)
+	}
+	if os.Geteuid() != 0 {
+		return nil, 0, fmt.Errorf("verify mounts the image and requires root privileges")
+	}
+
+	mountPoint, err := os.MkdirTemp("", "fsify-verify-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create mount point: %w", err)
+	}
+	defer os.Remove(mountPoint)
+
+	ctx := &ConversionContext{NoColor: noColor}
+	if err := ctx.runCommand("mount", "-o", "loop,ro", imagePath, mountPoint); err != nil {
+		return nil, 0, fmt.Errorf("failed to mount %s: %w", imagePath, err)
+	}
+	defer ctx.runCommand("umount", mountPoint)
+
+	actual, err := collectManifest(mountPoint, runtime.NumCPU())
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read image contents: %w", err)
+	}
+	return compareManifest(manifest.Entries, actual), len(manifest.Entries), nil
+}
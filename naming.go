@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// defaultNameTemplate gives nginx-latest.img, or nginx-<digest>.img for pinned references.
+const defaultNameTemplate = `{{.Repo}}{{with .Tag}}-{{.}}{{end}}{{if .Pinned}}-{{.Digest}}{{end}}.{{.Ext}}`
+
+var (
+	unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._+-]+`)
+	repeatedDashes  = regexp.MustCompile(`-{2,}`)
+)
+
+// nameFields are the values available to --name-template. Every string is
+// sanitized so it is safe in a file name.
+type nameFields struct {
+	Repo     string // Last path component of the repository, e.g. nginx
+	Tag      string // Tag, "latest" when the reference names neither tag nor digest
+	Digest   string // First 12 hex digits of the resolved manifest digest
+	Pinned   bool   // The reference was given by digest
+	OS       string
+	Arch     string // Architecture, with the variant if any, e.g. arm64-v8
+	Platform string // e.g. linux-amd64
+	FsType   string // ext4, xfs, ..., squashfs
+	Ext      string // img or squashfs
+}
+
+// sanitizeNameField replaces anything but letters, digits, '.', '_', '+' and
+// '-' with '-', so ports, slashes and colons never reach the file name.
+func sanitizeNameField(s string) string {
+	return strings.TrimLeft(unsafeNameChars.ReplaceAllString(s, "-"), ".-")
+}
+
+// newNameFields collects the naming fields for the current conversion.
+func newNameFields(ctx *ConversionContext) nameFields {
+	repo, tag, pinned := splitImageRef(ctx.ImageRef)
+	if tag == "" && pinned == "" {
+		tag = "latest"
+	}
+	fields := nameFields{
+		Repo:   sanitizeNameField(repo[strings.LastIndex(repo, "/")+1:]),
+		Tag:    sanitizeNameField(tag),
+		Digest: shortDigest(ctx.sourceDigest()),
+		Pinned: pinned != "",
+	}
+	if fields.Digest == "" {
+		fields.Digest = shortDigest(pinned)
+	}
+	if ctx.BuildInfo != nil && ctx.BuildInfo.Platform != "" {
+		parts := strings.SplitN(ctx.BuildInfo.Platform, "/", 2)
+		fields.OS = sanitizeNameField(parts[0])
+		if len(parts) == 2 {
+			fields.Arch = sanitizeNameField(parts[1])
+		}
+		fields.Platform = sanitizeNameField(ctx.BuildInfo.Platform)
+	}
+	return fields
+}
+
+// renderName executes the name template for one output.
+func renderName(tmpl *template.Template, fields nameFields, fsType, ext string) (string, error) {
+	fields.FsType, fields.Ext = fsType, ext
+	var b strings.Builder
+	if err := tmpl.Execute(&b, fields); err != nil {
+		return "", fmt.Errorf("failed to apply name template: %w", err)
+	}
+	name := b.String()
+	// Empty fields would otherwise leave separators behind, e.g. "nginx--amd64"
+	name = repeatedDashes.ReplaceAllString(name, "-")
+	name = strings.ReplaceAll(name, "-.", ".")
+	name = strings.Trim(name, "-")
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("name template produced an invalid file name %q", name)
+	}
+	return name, nil
+}
+
+// parseNameTemplate parses --name-template and checks it against sample fields.
+func parseNameTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultNameTemplate
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --name-template: %w", err)
+	}
+	sample := nameFields{Repo: "repo", Tag: "tag", Digest: "0123456789ab", OS: "linux", Arch: "amd64", Platform: "linux-amd64"}
+	if _, err := renderName(tmpl, sample, "ext4", "img"); err != nil {
+		return nil, fmt.Errorf("invalid --name-template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// resolveOutputPaths names the final image, squashfs and sidecars. It runs
+// after the pull so the template can use the resolved digest and platform.
+func resolveOutputPaths(ctx *ConversionContext) error {
+	if ctx.OutputFile != "" {
+		ctx.FinalPath = ctx.OutputFile
+		if ctx.DualOutput {
+			base := strings.TrimSuffix(ctx.OutputFile, filepath.Ext(ctx.OutputFile))
+			ctx.FinalSquashfsPath = base + ".squashfs"
+		}
+	} else {
+		tmpl, err := parseNameTemplate(ctx.NameTemplate)
+		if err != nil {
+			return err
+		}
+		fields := newNameFields(ctx)
+		name, err := renderName(tmpl, fields, ctx.FsType, "img")
+		if err != nil {
+			return err
+		}
+		ctx.FinalPath = filepath.Join(ctx.OutputDir, name)
+		if ctx.DualOutput {
+			name, err := renderName(tmpl, fields, "squashfs", "squashfs")
+			if err != nil {
+				return err
+			}
+			ctx.FinalSquashfsPath = filepath.Join(ctx.OutputDir, name)
+			if ctx.FinalSquashfsPath == ctx.FinalPath {
+				return fmt.Errorf("--name-template gives the image and squashfs the same name; include {{.Ext}} or {{.FsType}}")
+			}
+		}
+	}
+
+	// Sidecars always sit next to the primary image
+	ctx.FinalProvenancePath = ctx.FinalPath + provenanceSuffix
+	if ctx.SBOMFormat != "" {
+		ctx.FinalSBOMPath = ctx.FinalPath + sbomExtension(ctx.SBOMFormat)
+	}
+	if ctx.ManifestPath != "" {
+		ctx.FinalManifestPath = ctx.FinalPath + manifestSuffix
+	}
+	if ctx.CloudInitPath != "" {
+		ctx.FinalCloudInitPath = ctx.FinalPath + cloudInitSuffix
+	}
+	return nil
+}
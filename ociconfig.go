@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// OCIConfig is the image configuration blob (see the OCI image-spec
+// config documentation). Docker writes the same document.
+type OCIConfig struct {
+	Created      string             `json:"created,omitempty"`
+	Author       string             `json:"author,omitempty"`
+	Architecture string             `json:"architecture"`
+	OS           string             `json:"os"`
+	Variant      string             `json:"variant,omitempty"`
+	Config       OCIContainerConfig `json:"config"`
+	RootFS       OCIRootFS          `json:"rootfs"`
+	History      []OCIHistory       `json:"history,omitempty"`
+}
+
+// OCIContainerConfig is the default runtime configuration of the image.
+type OCIContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Healthcheck  *OCIHealthcheck     `json:"Healthcheck,omitempty"` // Docker extension
+}
+
+// OCIHealthcheck is Docker's HEALTHCHECK. Durations are nanoseconds.
+type OCIHealthcheck struct {
+	Test          []string      `json:"Test,omitempty"` // ["NONE"], ["CMD", ...] or ["CMD-SHELL", cmd]
+	Interval      time.Duration `json:"Interval,omitempty"`
+	Timeout       time.Duration `json:"Timeout,omitempty"`
+	StartPeriod   time.Duration `json:"StartPeriod,omitempty"`
+	StartInterval time.Duration `json:"StartInterval,omitempty"`
+	Retries       int           `json:"Retries,omitempty"`
+}
+
+type OCIRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type OCIHistory struct {
+	Created    string `json:"created,omitempty"`
+	CreatedBy  string `json:"created_by,omitempty"`
+	Comment    string `json:"comment,omitempty"`
+	EmptyLayer bool   `json:"empty_layer,omitempty"`
+}
+
+// defaultPath is the PATH container runtimes use when the image sets none.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// parseOciConfig decodes an image configuration blob.
+func parseOciConfig(data []byte) (*OCIConfig, error) {
+	var config OCIConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse OCI config: %w", err)
+	}
+	return &config, nil
+}
+
+// loadOciConfig reads the config of the image in an OCI layout.
+func loadOciConfig(layoutPath string) (*OCIConfig, []byte, error) {
+	manifest, err := loadOciManifest(layoutPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest.Config.Digest == "" {
+		return nil, nil, fmt.Errorf("OCI manifest has no config")
+	}
+	data, err := os.ReadFile(ociBlobPath(layoutPath, manifest.Config.Digest))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read OCI config: %w", err)
+	}
+	config, err := parseOciConfig(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, data, nil
+}
+
+// command is the process the image runs: Entrypoint followed by Cmd.
+func (c *OCIContainerConfig) command() []string {
+	return append(append([]string{}, c.Entrypoint...), c.Cmd...)
+}
+
+// getenv returns the value of name in Env.
+func (c *OCIContainerConfig) getenv(name string) (string, bool) {
+	for _, env := range c.Env {
+		if key, value, _ := strings.Cut(env, "="); key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// searchPath is the image's PATH, or the runtime default.
+func (c *OCIContainerConfig) searchPath() string {
+	if p, ok := c.getenv("PATH"); ok {
+		return p
+	}
+	return defaultPath
+}
+
+// userGroup splits User into its user and optional group, each a name or ID.
+func (c *OCIContainerConfig) userGroup() (string, string) {
+	user, group, _ := strings.Cut(c.User, ":")
+	return user, group
+}
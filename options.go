@@ -0,0 +1,97 @@
+package main
+
+import (
+	"runtime"
+	"slices"
+)
+
+// convertOptions are the settings for one conversion. The command line
+// fills one set; a build spec fills one per image, on top of its defaults.
+type convertOptions struct {
+	Output       string `yaml:"output"` // Overrides OutputDir and NameTemplate
+	OutputDir    string `yaml:"outputDir"`
+	NameTemplate string `yaml:"nameTemplate"`
+	Force        bool   `yaml:"force"`
+	WorkDir      string `yaml:"workdir"`
+	KeepWorkDir  bool   `yaml:"keepWorkdir"`
+	CacheDir     string `yaml:"cacheDir"`
+	NoCache      bool   `yaml:"noCache"`
+
+	FsType      string `yaml:"fs"`
+	BufferMB    int    `yaml:"bufferMB"`
+	Preallocate bool   `yaml:"preallocate"`
+	DualOutput  bool   `yaml:"dualOutput"`
+	Stream      bool   `yaml:"stream"`
+	CopyJobs    int    `yaml:"copyJobs"`
+
+	Add    stringList `yaml:"add"` // src:dst[:mode[:uid:gid]]
+	AddTar stringList `yaml:"addTar"`
+
+	Exclude     stringList `yaml:"exclude"`
+	ExcludeFrom stringList `yaml:"excludeFrom"`
+	Slim        bool       `yaml:"slim"`
+	KeepLocales string     `yaml:"keepLocales"` // Comma-separated
+
+	Hostname string     `yaml:"hostname"`
+	DNS      stringList `yaml:"dns"`
+	Fstab    string     `yaml:"fstab"` // auto or none
+	Tmpfs    stringList `yaml:"tmpfs"` // path[:options]
+
+	CloudInit     string `yaml:"cloudInit"` // user-data for the NoCloud seed
+	MetaData      string `yaml:"metaData"`
+	NetworkConfig string `yaml:"networkConfig"`
+
+	Overlay        stringList `yaml:"overlay"`
+	EntrypointFrom string     `yaml:"entrypointFrom"`
+
+	Init string `yaml:"init"`
+
+	User              string     `yaml:"user"`
+	SSHAuthorizedKeys stringList `yaml:"sshAuthorizedKeys"`
+	RootPasswordHash  string     `yaml:"rootPasswordHash"`
+
+	Size        string  `yaml:"size"`
+	FreeSpace   string  `yaml:"freeSpace"`
+	FreePercent float64 `yaml:"freePercent"`
+	MinInodes   int64   `yaml:"minInodes"`
+
+	Label           string  `yaml:"label"`
+	UUID            string  `yaml:"uuid"`
+	BlockSize       int     `yaml:"blockSize"`
+	InodeSize       int     `yaml:"inodeSize"`
+	InodeRatio      int     `yaml:"inodeRatio"`
+	Ext4Features    string  `yaml:"ext4Features"` // Comma-separated
+	NoJournal       bool    `yaml:"noJournal"`
+	ReservedPercent float64 `yaml:"reservedPercent"`
+	XFSReflink      string  `yaml:"xfsReflink"`
+	BtrfsCompress   string  `yaml:"btrfsCompress"`
+
+	SBOM            string     `yaml:"sbom"`
+	SBOMEmbed       bool       `yaml:"sbomEmbed"`
+	Manifest        bool       `yaml:"manifest"`
+	VerifySignature bool       `yaml:"verifySignature"`
+	SignatureKeys   stringList `yaml:"signatureKeys"`
+	SignaturePolicy string     `yaml:"signaturePolicy"`
+	RequireDigest   bool       `yaml:"requireDigest"`
+}
+
+// defaultConvertOptions are the defaults shared by flags and build specs.
+func defaultConvertOptions() convertOptions {
+	return convertOptions{
+		CacheDir:        defaultCacheDir(),
+		FsType:          "ext4",
+		BufferMB:        50,
+		CopyJobs:        runtime.NumCPU(),
+		ReservedPercent: -1,
+		KeepLocales:     "en",
+	}
+}
+
+// clone returns a copy of o whose lists share no backing array with o, so
+// resolving or appending to one image's lists leaves the defaults alone.
+func (o convertOptions) clone() convertOptions {
+	for _, list := range []*stringList{&o.Add, &o.AddTar, &o.Exclude, &o.ExcludeFrom, &o.DNS, &o.Tmpfs, &o.Overlay, &o.SSHAuthorizedKeys, &o.SignatureKeys} {
+		*list = slices.Clone(*list)
+	}
+	return o
+}
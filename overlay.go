@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// overlayImage is one --overlay image. Its blobs are linked into the base
+// image's OCI layout, so its layers open like the base image's own.
+type overlayImage struct {
+	Ref      string
+	Digest   string // Manifest digest the image was pulled by
+	Manifest *OCIManifest
+}
+
+// overlayInfo records an --overlay image in the build info.
+type overlayInfo struct {
+	Source       string   `json:"source"`
+	Digest       string   `json:"digest,omitempty"`
+	ConfigDigest string   `json:"configDigest,omitempty"`
+	Layers       []string `json:"layers,omitempty"`
+}
+
+// downloadOverlayImages pulls every --overlay image into its own OCI layout,
+// with the same signature checks and layer cache as the base image, then
+// links its blobs into the base layout.
+func downloadOverlayImages(ctx *ConversionContext) error {
+	baseBlobs := filepath.Join(ctx.OciLayoutPath, "blobs", "sha256")
+	for i := range ctx.Overlays {
+		overlay := &ctx.Overlays[i]
+		sub := *ctx
+		sub.ImageRef = overlay.Ref
+		sub.ImageDigest = ""
+		sub.OciLayoutPath = filepath.Join(ctx.TempDir, fmt.Sprintf("oci-overlay-%d", i+1))
+		if err := os.Mkdir(sub.OciLayoutPath, 0755); err != nil {
+			return fmt.Errorf("failed to create dir %s: %w", sub.OciLayoutPath, err)
+		}
+		if err := downloadOciImage(&sub); err != nil {
+			return fmt.Errorf("failed to pull overlay %s: %w", overlay.Ref, err)
+		}
+		manifest, err := loadOciManifest(sub.OciLayoutPath)
+		if err != nil {
+			return err
+		}
+		overlay.Digest = sub.ImageDigest
+		overlay.Manifest = manifest
+
+		for _, desc := range append([]OCDescriptor{manifest.Config}, manifest.Layers...) {
+			src := ociBlobPath(sub.OciLayoutPath, desc.Digest)
+			if err := linkOrCopy(src, filepath.Join(baseBlobs, filepath.Base(src))); err != nil {
+				return err
+			}
+		}
+		if ctx.Verbose {
+			fmt.Printf("%s Pulled overlay %s (%s, %d layers)\n", colorize("│", "cyan", ctx.NoColor), overlay.Ref, overlay.Digest, len(manifest.Layers))
+		}
+	}
+	return nil
+}
+
+// applyOverlayImages extracts the layers of every --overlay image over the
+// unpacked rootfs, in order, so their whiteouts also remove files that came
+// from the base image or an earlier overlay.
+func applyOverlayImages(ctx *ConversionContext) error {
+	root := ctx.rootfsPath()
+	for _, overlay := range ctx.Overlays {
+		for i, layer := range overlay.Manifest.Layers {
+			rc, err := openLayer(ctx.OciLayoutPath, layer)
+			if err != nil {
+				return err
+			}
+			err = applyTarToRootfs(root, rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("failed to apply layer %s of %s: %w", layer.Digest, overlay.Ref, err)
+			}
+			if ctx.Verbose {
+				fmt.Printf("%s Applied %s layer %d/%d (%s)\n", colorize("│", "cyan", ctx.NoColor), overlay.Ref, i+1, len(overlay.Manifest.Layers), layer.Digest)
+			}
+		}
+	}
+	return nil
+}
+
+// overlayLayers returns the layers of every --overlay image, bottom to top.
+func (ctx *ConversionContext) overlayLayers() []OCDescriptor {
+	var layers []OCDescriptor
+	for _, overlay := range ctx.Overlays {
+		layers = append(layers, overlay.Manifest.Layers...)
+	}
+	return layers
+}
+
+// mergeImageConfigs combines the base and overlay image configs into the
+// one recorded in the rootfs. The primary image (--entrypoint-from, by
+// default the base) provides the Entrypoint, Cmd, User, WorkingDir and the
+// rest of its config. Env and Labels are merged in image order with the
+// primary's applied last, so its values win; ExposedPorts and Volumes are
+// the union of all images. The layer diff IDs and history are concatenated.
+func mergeImageConfigs(ctx *ConversionContext, base []byte) ([]byte, error) {
+	var baseDoc map[string]any
+	if err := json.Unmarshal(base, &baseDoc); err != nil {
+		return nil, fmt.Errorf("failed to parse config of %s: %w", ctx.ImageRef, err)
+	}
+	configs := []map[string]any{baseDoc}
+	for _, overlay := range ctx.Overlays {
+		data, err := os.ReadFile(ociBlobPath(ctx.OciLayoutPath, overlay.Manifest.Config.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config of %s: %w", overlay.Ref, err)
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("failed to parse config of %s: %w", overlay.Ref, err)
+		}
+		configs = append(configs, doc)
+	}
+
+	primary := 0
+	for i, overlay := range ctx.Overlays {
+		if overlay.Ref == ctx.EntrypointFrom {
+			primary = i + 1
+		}
+	}
+	// The primary's settings are applied last, so they win
+	order := make([]int, 0, len(configs))
+	for i := range configs {
+		if i != primary {
+			order = append(order, i)
+		}
+	}
+	order = append(order, primary)
+
+	var envNames []string
+	env := map[string]string{}
+	labels := map[string]any{}
+	ports := map[string]any{}
+	volumes := map[string]any{}
+	var diffIDs, history []any
+	for _, i := range order {
+		config, _ := configs[i]["config"].(map[string]any)
+		list, _ := config["Env"].([]any)
+		for _, item := range list {
+			s, _ := item.(string)
+			name, value, _ := strings.Cut(s, "=")
+			if _, ok := env[name]; !ok {
+				envNames = append(envNames, name)
+			}
+			env[name] = value
+		}
+		for _, field := range []struct {
+			name string
+			into map[string]any
+		}{{"Labels", labels}, {"ExposedPorts", ports}, {"Volumes", volumes}} {
+			m, _ := config[field.name].(map[string]any)
+			for k, v := range m {
+				field.into[k] = v
+			}
+		}
+	}
+	// Layers stay in the order they were applied: base, then each overlay
+	for _, doc := range configs {
+		if rootfs, ok := doc["rootfs"].(map[string]any); ok {
+			ids, _ := rootfs["diff_ids"].([]any)
+			diffIDs = append(diffIDs, ids...)
+		}
+		h, _ := doc["history"].([]any)
+		history = append(history, h...)
+	}
+
+	merged := configs[primary]
+	config, _ := merged["config"].(map[string]any)
+	if config == nil {
+		config = map[string]any{}
+		merged["config"] = config
+	}
+	if len(envNames) > 0 {
+		list := make([]any, 0, len(envNames))
+		for _, name := range envNames {
+			list = append(list, name+"="+env[name])
+		}
+		config["Env"] = list
+	}
+	for name, m := range map[string]map[string]any{"Labels": labels, "ExposedPorts": ports, "Volumes": volumes} {
+		if len(m) > 0 {
+			config[name] = m
+		}
+	}
+	if len(diffIDs) > 0 {
+		merged["rootfs"] = map[string]any{"type": "layers", "diff_ids": diffIDs}
+	}
+	if len(history) > 0 {
+		merged["history"] = history
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode merged config: %w", err)
+	}
+	if ctx.Verbose {
+		ref := ctx.ImageRef
+		if primary > 0 {
+			ref = ctx.Overlays[primary-1].Ref
+		}
+		fmt.Printf("%s Merged %d image configs, entrypoint from %s\n", colorize("│", "blue", ctx.NoColor), len(configs), ref)
+	}
+	return data, nil
+}
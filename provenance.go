@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaPredicateType   = "https://slsa.dev/provenance/v1"
+	fsifyBuildType      = "https://github.com/ccheshirecat/fsify/build/v1"
+	fsifyBuilderID      = "https://github.com/ccheshirecat/fsify"
+)
+
+// provenanceSuffix is appended to the primary output path for the sidecar.
+const provenanceSuffix = ".intoto.jsonl"
+
+// In-toto statement with a SLSA v1 provenance predicate
+type inTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+type resourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   map[string]any       `json:"externalParameters"`
+		ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  string `json:"startedOn"`
+			FinishedOn string `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// sha256File hashes a file, returning the hex digest.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestMap turns "sha256:abc" into {"sha256": "abc"}.
+func digestMap(digest string) map[string]string {
+	algo, value, ok := strings.Cut(digest, ":")
+	if !ok {
+		return map[string]string{"sha256": digest}
+	}
+	return map[string]string{algo: value}
+}
+
+// writeProvenance writes an in-toto statement describing how the outputs
+// were produced. Images are hashed in the work directory but named after
+// their final paths.
+func writeProvenance(ctx *ConversionContext) error {
+	info := ctx.BuildInfo
+	if info == nil {
+		info = newBuildInfo(ctx)
+	}
+
+	stmt := inTotoStatement{
+		Type:          inTotoStatementType,
+		PredicateType: slsaPredicateType,
+	}
+	images := ctx.finalOutputs()[:1]
+	if ctx.DualOutput {
+		images = ctx.finalOutputs()[:2]
+	}
+	for _, image := range images {
+		sum, err := sha256File(image.src)
+		if err != nil {
+			return fmt.Errorf("failed to hash %s: %w", image.src, err)
+		}
+		stmt.Subject = append(stmt.Subject, resourceDescriptor{Name: filepath.Base(image.dest), Digest: map[string]string{"sha256": sum}})
+	}
+
+	pred := &stmt.Predicate
+	pred.BuildDefinition.BuildType = fsifyBuildType
+	pred.BuildDefinition.ExternalParameters = map[string]any{
+		"source":  info.Source,
+		"options": info.Options,
+	}
+	if len(info.Overlays) > 0 {
+		var overlays []string
+		for _, overlay := range info.Overlays {
+			overlays = append(overlays, overlay.Source)
+		}
+		pred.BuildDefinition.ExternalParameters["overlays"] = overlays
+		if info.EntrypointFrom != "" {
+			pred.BuildDefinition.ExternalParameters["entrypointFrom"] = info.EntrypointFrom
+		}
+	}
+	if len(info.Added) > 0 {
+		pred.BuildDefinition.ExternalParameters["added"] = info.Added
+	}
+	pred.BuildDefinition.ResolvedDependencies = []resourceDescriptor{}
+	if info.Digest != "" {
+		image := resourceDescriptor{URI: "docker://" + info.Source, Digest: digestMap(info.Digest)}
+		if info.Platform != "" {
+			image.Name = info.Platform
+		}
+		pred.BuildDefinition.ResolvedDependencies = append(pred.BuildDefinition.ResolvedDependencies, image)
+	} else if info.LocalDigest != "" {
+		image := resourceDescriptor{URI: "docker-daemon:" + info.Source, Digest: digestMap(info.LocalDigest)}
+		if info.Platform != "" {
+			image.Name = info.Platform
+		}
+		pred.BuildDefinition.ResolvedDependencies = append(pred.BuildDefinition.ResolvedDependencies, image)
+	}
+	for _, layer := range info.Layers {
+		pred.BuildDefinition.ResolvedDependencies = append(pred.BuildDefinition.ResolvedDependencies,
+			resourceDescriptor{Name: "layer", Digest: digestMap(layer)})
+	}
+	for _, overlay := range info.Overlays {
+		if overlay.Digest != "" {
+			pred.BuildDefinition.ResolvedDependencies = append(pred.BuildDefinition.ResolvedDependencies,
+				resourceDescriptor{URI: "docker://" + overlay.Source, Digest: digestMap(overlay.Digest)})
+		}
+		for _, layer := range overlay.Layers {
+			pred.BuildDefinition.ResolvedDependencies = append(pred.BuildDefinition.ResolvedDependencies,
+				resourceDescriptor{Name: "layer", Digest: digestMap(layer)})
+		}
+	}
+	for _, added := range info.Added {
+		pred.BuildDefinition.ResolvedDependencies = append(pred.BuildDefinition.ResolvedDependencies,
+			resourceDescriptor{URI: "file://" + added.Source, Name: added.Dest, Digest: digestMap(added.Digest)})
+	}
+
+	pred.RunDetails.Builder.ID = fsifyBuilderID
+	pred.RunDetails.Builder.Version = map[string]string{"fsify": Version, "buildDate": BuildDate}
+	pred.RunDetails.Metadata.StartedOn = info.Timestamp
+	finished := time.Now().UTC()
+	if os.Getenv("SOURCE_DATE_EPOCH") != "" {
+		finished = buildTime(ctx)
+	}
+	pred.RunDetails.Metadata.FinishedOn = finished.Format(time.RFC3339)
+
+	data, err := json.Marshal(stmt)
+	if err != nil {
+		return fmt.Errorf("failed to encode provenance: %w", err)
+	}
+	if err := os.WriteFile(ctx.ProvenancePath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write provenance: %w", err)
+	}
+	return nil
+}
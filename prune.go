@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// slimPatterns are the paths --slim removes: package manager caches and
+// indexes, documentation, and the leftovers of a container build.
+var slimPatterns = []string{
+	"/.dockerenv",
+	"/var/cache/apt/*",
+	"/var/lib/apt/lists/*",
+	"/var/cache/apk/*",
+	"/var/cache/dnf/*",
+	"/var/cache/yum/*",
+	"/var/cache/debconf/*-old",
+	"/var/log/apt/*",
+	"/var/log/dnf*",
+	"/usr/share/doc/*",
+	"/usr/share/man/*",
+	"/usr/share/info/*",
+	"/usr/share/groff/*",
+	"/usr/share/lintian/*",
+	"/usr/share/linda/*",
+	"/tmp/*",
+	"/var/tmp/*",
+	"/root/.cache",
+	"*.pyc",
+	"__pycache__",
+}
+
+// excludeRule is one --exclude pattern. Patterns starting with / match the
+// whole path in the image, others match the file name anywhere; a leading !
+// keeps a path an earlier pattern excluded.
+type excludeRule struct {
+	pattern string
+	keep    bool
+}
+
+// excluder decides which rootfs paths are pruned. The last matching rule
+// wins, and an excluded directory is removed with everything below it.
+type excluder struct {
+	rules    []excludeRule
+	patterns []string // As given, for the build record
+}
+
+// newExcluder builds the rules from the --slim profile, then --exclude-from
+// files, then --exclude patterns, so later ones can override earlier ones.
+func newExcluder(patterns, files []string, slim bool, keepLocales string) (*excluder, error) {
+	var all []string
+	if slim {
+		all = append(all, slimPatterns...)
+		all = append(all, "/usr/share/locale/*")
+		for _, lang := range strings.Split(keepLocales, ",") {
+			if lang = strings.TrimSpace(lang); lang != "" {
+				all = append(all, "!/usr/share/locale/"+lang, "!/usr/share/locale/"+lang+"[_.@]*")
+			}
+		}
+	}
+	for _, file := range files {
+		filePatterns, err := readExcludeFile(file)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, filePatterns...)
+	}
+	all = append(all, patterns...)
+	if len(all) == 0 {
+		return nil, nil
+	}
+
+	e := &excluder{patterns: all}
+	for _, pattern := range all {
+		rule := excludeRule{pattern: pattern}
+		if rest, ok := strings.CutPrefix(pattern, "!"); ok {
+			rule = excludeRule{pattern: rest, keep: true}
+		}
+		rule.pattern = strings.TrimSuffix(rule.pattern, "/")
+		if _, err := path.Match(rule.pattern, ""); err != nil || rule.pattern == "" {
+			return nil, fmt.Errorf("invalid exclude pattern %q", pattern)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	return e, nil
+}
+
+// readExcludeFile reads one pattern per line; blank lines and # comments are skipped.
+func readExcludeFile(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exclude file: %w", err)
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read exclude file %s: %w", file, err)
+	}
+	return patterns, nil
+}
+
+// excluded reports whether the rules remove p, an absolute path in the image.
+func (e *excluder) excluded(p string) bool {
+	result := false
+	for _, rule := range e.rules {
+		target := p
+		if !strings.HasPrefix(rule.pattern, "/") {
+			target = path.Base(p)
+		}
+		if ok, _ := path.Match(rule.pattern, target); ok {
+			result = !rule.keep
+		}
+	}
+	return result
+}
+
+// excludedTree reports whether p or one of its parent directories is excluded.
+func (e *excluder) excludedTree(p string) bool {
+	for i := 1; i < len(p); i++ {
+		if p[i] == '/' && e.excluded(p[:i]) {
+			return true
+		}
+	}
+	return e.excluded(p)
+}
+
+// pruneRootfs removes excluded paths before the image is sized, from the
+// unpacked rootfs or, in stream mode, from the merged tree.
+func pruneRootfs(ctx *ConversionContext) error {
+	if ctx.Merged != nil {
+		for name, entry := range ctx.Merged.Entries {
+			if !ctx.Exclude.excludedTree("/" + name) {
+				continue
+			}
+			if entry.Header.Typeflag == tar.TypeReg {
+				ctx.Merged.Size -= entry.Header.Size
+				ctx.PrunedBytes += entry.Header.Size
+			}
+			ctx.PrunedPaths++
+			delete(ctx.Merged.Entries, name)
+		}
+	} else {
+		root := ctx.rootfsPath()
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == root {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if !ctx.Exclude.excluded("/" + filepath.ToSlash(rel)) {
+				return nil
+			}
+			if err := ctx.countPruned(p); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return fmt.Errorf("failed to remove /%s: %w", rel, err)
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if ctx.Verbose {
+		fmt.Printf("%s Excluded %d paths, %s of file data\n", colorize("│", "blue", ctx.NoColor), ctx.PrunedPaths, formatBytes(ctx.PrunedBytes))
+	}
+	return nil
+}
+
+// countPruned adds everything at and below p to the pruned totals.
+func (ctx *ConversionContext) countPruned(p string) error {
+	return filepath.WalkDir(p, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ctx.PrunedPaths++
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			ctx.PrunedBytes += info.Size()
+		}
+		return nil
+	})
+}
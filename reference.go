@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// splitImageRef splits "host/repo:tag@sha256:..." into its repository, tag
+// and digest. A port in the registry host is not mistaken for a tag.
+func splitImageRef(ref string) (repo, tag, digest string) {
+	repo, digest, _ = strings.Cut(ref, "@")
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	return repo, tag, digest
+}
+
+// validateImageRef checks a pinned digest and, with requireDigest, rejects
+// references that only name a mutable tag.
+func validateImageRef(ref string, requireDigest bool) error {
+	repo, _, digest := splitImageRef(ref)
+	if repo == "" {
+		return fmt.Errorf("invalid image reference %q", ref)
+	}
+	if digest != "" && !digestPattern.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q in %s (expected sha256:<64 hex>)", digest, ref)
+	}
+	if requireDigest && digest == "" {
+		return fmt.Errorf("%s is not pinned; --require-digest needs a reference like %s@sha256:...", ref, repo)
+	}
+	return nil
+}
+
+// shortDigest returns the first 12 hex characters of a digest.
+func shortDigest(digest string) string {
+	_, hexPart, _ := strings.Cut(digest, ":")
+	if len(hexPart) > 12 {
+		hexPart = hexPart[:12]
+	}
+	return hexPart
+}
+
+// sourceDigest identifies the image content for names and stable IDs: the
+// registry digest, or the local manifest digest for a docker-daemon copy.
+func (ctx *ConversionContext) sourceDigest() string {
+	if ctx.ImageDigest != "" {
+		return ctx.ImageDigest
+	}
+	return ctx.LocalDigest
+}
+
+// resolveRegistryDigest fetches the manifest (or index) the reference points
+// to and returns its digest. A pinned reference must resolve to its own digest.
+func resolveRegistryDigest(ctx *ConversionContext) (string, error) {
+	raw, err := ctx.inspectRaw(ctx.ImageRef)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s in the registry: %w", ctx.ImageRef, err)
+	}
+	sum := sha256.Sum256(raw)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if _, _, pinned := splitImageRef(ctx.ImageRef); pinned != "" && pinned != digest {
+		return "", fmt.Errorf("registry returned %s for %s", digest, ctx.ImageRef)
+	}
+	return digest, nil
+}
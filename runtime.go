@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Guest paths of the files generated from the image config
+const (
+	runtimeEnvPath      = "/etc/fsify/env"
+	runtimeLauncherPath = "/etc/fsify/run"
+	runtimeUnitPath     = "/etc/systemd/system/fsify-app.service"
+	runtimeInitPath     = "/etc/init.d/fsify-app"
+)
+
+// stopSignals are the signal names a stop signal may use, as kill(1) knows them.
+var stopSignals = map[string]int{
+	"HUP": 1, "INT": 2, "QUIT": 3, "ILL": 4, "TRAP": 5, "ABRT": 6, "BUS": 7, "FPE": 8,
+	"KILL": 9, "USR1": 10, "SEGV": 11, "USR2": 12, "PIPE": 13, "ALRM": 14, "TERM": 15,
+	"CHLD": 17, "CONT": 18, "STOP": 19, "TSTP": 20, "TTIN": 21, "TTOU": 22, "URG": 23,
+	"XCPU": 24, "XFSZ": 25, "VTALRM": 26, "PROF": 27, "WINCH": 28, "IO": 29, "PWR": 30, "SYS": 31,
+}
+
+// runtimeTranslation records how the image config was carried over to the
+// guest: what runs, how it is started and what could not be honored.
+type runtimeTranslation struct {
+	Command    []string `json:"command,omitempty"` // Entrypoint and Cmd, executable resolved on the image PATH
+	User       string   `json:"user,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	StopSignal string   `json:"stopSignal,omitempty"`
+	Service    string   `json:"service,omitempty"` // systemd unit or init script that was written
+	Init       string   `json:"init,omitempty"`    // "systemd" when --init systemd enabled the unit
+	Masked     []string `json:"masked,omitempty"`  // Units masked by --init systemd
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+func (rt *runtimeTranslation) warn(format string, args ...any) {
+	rt.Warnings = append(rt.Warnings, fmt.Sprintf(format, args...))
+}
+
+// translateImageConfig turns the image config into files a VM can use in
+// place of a container runtime: the environment as /etc/fsify/env, a shell
+// launcher at /etc/fsify/run that starts the entrypoint as the image's user,
+// and a systemd unit, or an init script on images without systemd. None of
+// them is enabled here. Settings a VM cannot honor become warnings.
+func translateImageConfig(ctx *ConversionContext) error {
+	if ctx.ImageConfig == nil {
+		return nil
+	}
+	cfg := &ctx.ImageConfig.Config
+	rt := &runtimeTranslation{User: cfg.User, WorkingDir: cfg.WorkingDir, StopSignal: "SIGTERM"}
+	ctx.Runtime = rt
+
+	if err := writeRootfsFile(ctx, runtimeEnvPath, []byte(envFile(cfg.Env)), 0644); err != nil {
+		return err
+	}
+
+	if cfg.StopSignal != "" {
+		if signal, ok := normalizeSignal(cfg.StopSignal); ok {
+			rt.StopSignal = signal
+		} else {
+			rt.warn("StopSignal %q is not a known signal; SIGTERM is used", cfg.StopSignal)
+		}
+	}
+	if len(cfg.ExposedPorts) > 0 {
+		rt.warn("ExposedPorts %s are not forwarded; services listen on the guest's own network interfaces", strings.Join(sortedKeys(cfg.ExposedPorts), ", "))
+	}
+	if len(cfg.Volumes) > 0 {
+		rt.warn("Volumes %s are plain directories in the root filesystem, not separate mounts", strings.Join(sortedKeys(cfg.Volumes), ", "))
+	}
+	if hc := cfg.Healthcheck; hc != nil && len(hc.Test) > 0 && hc.Test[0] != "NONE" {
+		rt.warn("Healthcheck is not run; nothing restarts the service when it fails")
+	}
+	if user, _ := cfg.userGroup(); user != "" && ctx.Merged == nil && !isNumeric(user) {
+		if passwd, err := readAccountFile(ctx.rootfsPath(), "etc/passwd"); err == nil && passwd.find(user) == nil {
+			rt.warn("User %q is not in /etc/passwd; the service will fail to start", user)
+		}
+	}
+
+	command := cfg.command()
+	if len(command) == 0 {
+		rt.warn("the image has no Entrypoint or Cmd; no launcher or service was generated")
+		return nil
+	}
+	rt.Command = command
+	if resolved, ok := ctx.lookPath(command[0], cfg.searchPath()); ok {
+		rt.Command[0] = resolved
+	} else {
+		rt.warn("%s was not found on the image PATH", command[0])
+	}
+
+	_, hasShell := ctx.rootfsFileSize("bin/sh")
+	if hasShell {
+		if err := writeRootfsFile(ctx, runtimeLauncherPath, []byte(launcherScript(ctx, cfg)), 0755); err != nil {
+			return err
+		}
+	} else {
+		rt.warn("the image has no /bin/sh, so %s was not written", runtimeLauncherPath)
+	}
+
+	switch {
+	case hasSystemd(ctx):
+		if err := writeRootfsFile(ctx, runtimeUnitPath, []byte(systemdUnit(ctx, cfg, rt)), 0644); err != nil {
+			return err
+		}
+		rt.Service = runtimeUnitPath
+		if ctx.Init == "" && ctx.Verbose {
+			fmt.Printf("%s The image ships systemd; --init systemd enables %s\n", colorize("│", "cyan", ctx.NoColor), runtimeUnitPath)
+		}
+	case hasShell:
+		if err := writeRootfsFile(ctx, runtimeInitPath, []byte(initScript(rt)), 0755); err != nil {
+			return err
+		}
+		rt.Service = runtimeInitPath
+	}
+
+	if ctx.Verbose {
+		fmt.Printf("%s Runtime: %q as %q, service %s\n", colorize("│", "blue", ctx.NoColor), rt.Command, cfg.User, rt.Service)
+	}
+	return nil
+}
+
+// hasSystemd reports whether the rootfs ships systemd as its init.
+func hasSystemd(ctx *ConversionContext) bool {
+	for _, p := range []string{"usr/lib/systemd/systemd", "lib/systemd/systemd"} {
+		if _, ok := ctx.rootfsFileSize(p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lookPath resolves name against PATH in the rootfs, like the container
+// runtime does before it executes the entrypoint.
+func (ctx *ConversionContext) lookPath(name, searchPath string) (string, bool) {
+	if strings.Contains(name, "/") {
+		_, ok := ctx.rootfsFileSize(strings.TrimPrefix(name, "/"))
+		return name, ok
+	}
+	for _, dir := range strings.Split(searchPath, ":") {
+		if !strings.HasPrefix(dir, "/") {
+			continue
+		}
+		candidate := strings.TrimSuffix(dir, "/") + "/" + name
+		if _, ok := ctx.rootfsFileSize(strings.TrimPrefix(candidate, "/")); ok {
+			return candidate, true
+		}
+	}
+	return name, false
+}
+
+// normalizeSignal turns "SIGQUIT", "quit" or "3" into "SIGQUIT".
+func normalizeSignal(signal string) (string, bool) {
+	if n, err := strconv.Atoi(signal); err == nil {
+		for name, number := range stopSignals {
+			if number == n {
+				return "SIG" + name, true
+			}
+		}
+		return "", false
+	}
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if _, ok := stopSignals[name]; !ok {
+		return "", false
+	}
+	return "SIG" + name, true
+}
+
+// envFile renders Env so both systemd's EnvironmentFile= and a shell's "."
+// read the same values: every value is double quoted with \, ", $ and `
+// escaped.
+func envFile(env []string) string {
+	var b strings.Builder
+	b.WriteString("# Generated by fsify from the image config\n")
+	for _, entry := range env {
+		name, value, _ := strings.Cut(entry, "=")
+		if name == "" {
+			continue
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`", "\n", `\n`).Replace(value)
+		fmt.Fprintf(&b, "%s=\"%s\"\n", name, value)
+	}
+	return b.String()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellQuoteAll(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// systemdQuote quotes one ExecStart= argument unless it needs none.
+func systemdQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._=:,+-") == "" {
+		return s
+	}
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%", "$", "$$").Replace(s)
+	return `"` + s + `"`
+}
+
+// launcherScript starts the entrypoint the way a container runtime would:
+// with the image's environment and working directory, as the image's user,
+// with any arguments replacing Cmd.
+func launcherScript(ctx *ConversionContext, cfg *OCIContainerConfig) string {
+	var b strings.Builder
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Runs the entrypoint of %s. Generated by fsify from the image config.\n", ctx.ImageRef)
+	b.WriteString("set -a\n")
+	fmt.Fprintf(&b, ". %s\n", runtimeEnvPath)
+	b.WriteString("set +a\n")
+	if cfg.WorkingDir != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", shellQuote(cfg.WorkingDir))
+	}
+	if len(cfg.Cmd) > 0 {
+		fmt.Fprintf(&b, "[ $# -gt 0 ] || set -- %s\n", shellQuoteAll(cfg.Cmd))
+	}
+	exec := `"$@"`
+	if len(cfg.Entrypoint) > 0 {
+		exec = shellQuoteAll(cfg.Entrypoint) + ` "$@"`
+	}
+
+	if user, group := cfg.userGroup(); user != "" && user != "root" && user != "0" {
+		regid := shellQuote(group)
+		if group == "" {
+			regid = fmt.Sprintf(`"$(id -g %s 2>/dev/null || echo 0)"`, shellQuote(user))
+		}
+		groups := "--init-groups"
+		if isNumeric(user) {
+			groups = "--clear-groups"
+		}
+		b.WriteString("if [ \"$(id -u)\" = 0 ]; then\n")
+		fmt.Fprintf(&b, "\tcommand -v setpriv >/dev/null 2>&1 || { echo \"fsify: setpriv is needed to run as %s\" >&2; exit 1; }\n", user)
+		fmt.Fprintf(&b, "\texec setpriv --reuid=%s --regid=%s %s -- %s\n", shellQuote(user), regid, groups, exec)
+		b.WriteString("fi\n")
+	}
+	fmt.Fprintf(&b, "exec %s\n", exec)
+	return b.String()
+}
+
+// systemdUnit runs the resolved command directly, so images without a shell
+// work too. It is written but not enabled.
+func systemdUnit(ctx *ConversionContext, cfg *OCIContainerConfig, rt *runtimeTranslation) string {
+	args := make([]string, len(rt.Command))
+	for i, arg := range rt.Command {
+		args[i] = systemdQuote(arg)
+	}
+
+	var b strings.Builder
+	b.WriteString("# Generated by fsify from the image config\n")
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=Entrypoint of %s\n", ctx.ImageRef)
+	b.WriteString("Wants=network-online.target\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("\n[Service]\n")
+	b.WriteString("Type=simple\n")
+	fmt.Fprintf(&b, "EnvironmentFile=%s\n", runtimeEnvPath)
+	if cfg.WorkingDir != "" {
+		fmt.Fprintf(&b, "WorkingDirectory=%s\n", cfg.WorkingDir)
+	}
+	if user, group := cfg.userGroup(); user != "" {
+		fmt.Fprintf(&b, "User=%s\n", user)
+		if group != "" {
+			fmt.Fprintf(&b, "Group=%s\n", group)
+		}
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(args, " "))
+	fmt.Fprintf(&b, "KillSignal=%s\n", rt.StopSignal)
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// initScript is a plain sysvinit-style script around the launcher.
+func initScript(rt *runtimeTranslation) string {
+	signal := strings.TrimPrefix(rt.StopSignal, "SIG")
+	return fmt.Sprintf(`#!/bin/sh
+# Starts the image entrypoint through %[1]s. Generated by fsify.
+pidfile=/run/fsify-app.pid
+
+case "$1" in
+start)
+	%[1]s >>/var/log/fsify-app.log 2>&1 &
+	echo $! >"$pidfile"
+	;;
+stop)
+	[ -f "$pidfile" ] && kill -%[2]s "$(cat "$pidfile")" && rm -f "$pidfile"
+	;;
+restart)
+	"$0" stop
+	sleep 1
+	"$0" start
+	;;
+status)
+	if [ -f "$pidfile" ] && kill -0 "$(cat "$pidfile")" 2>/dev/null; then
+		echo running
+	else
+		echo stopped
+		exit 3
+	fi
+	;;
+*)
+	echo "usage: $0 {start|stop|restart|status}" >&2
+	exit 2
+	;;
+esac
+`, runtimeLauncherPath, signal)
+}
+
+func isNumeric(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// usrMergedContexts returns a merged tree and an unpacked rootfs of a
+// usr-merged image, where bin and sbin link to directories under usr.
+func usrMergedContexts(t *testing.T) map[string]*ConversionContext {
+	t.Helper()
+	tree := &mergedTree{Entries: map[string]*mergedEntry{}, Extra: map[string]*extraFile{}}
+	for name, hdr := range map[string]*tar.Header{
+		"usr":          {Typeflag: tar.TypeDir},
+		"usr/bin":      {Typeflag: tar.TypeDir},
+		"usr/bin/sh":   {Typeflag: tar.TypeReg, Size: 100},
+		"usr/sbin":     {Typeflag: tar.TypeDir},
+		"usr/sbin/app": {Typeflag: tar.TypeReg, Size: 200},
+		"bin":          {Typeflag: tar.TypeSymlink, Linkname: "usr/bin"},
+		"sbin":         {Typeflag: tar.TypeSymlink, Linkname: "/usr/sbin"},
+	} {
+		hdr.Name = name
+		tree.Entries[name] = &mergedEntry{Header: hdr}
+	}
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "rootfs")
+	for _, d := range []string{"usr/bin", "usr/sbin"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, size := range map[string]int{"usr/bin/sh": 100, "usr/sbin/app": 200} {
+		if err := os.WriteFile(filepath.Join(root, name), make([]byte, size), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{"bin": "usr/bin", "sbin": "/usr/sbin"} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return map[string]*ConversionContext{
+		"stream":   {Merged: tree},
+		"unpacked": {UnpackedPath: dir},
+	}
+}
+
+func TestRootfsFileSizeFollowsParentSymlinks(t *testing.T) {
+	for mode, ctx := range usrMergedContexts(t) {
+		t.Run(mode, func(t *testing.T) {
+			if size, ok := ctx.rootfsFileSize("bin/sh"); !ok || size != 100 {
+				t.Errorf("bin/sh: got %d, %v; want 100, true", size, ok)
+			}
+			// sbin is an absolute link, resolved inside the tree, not on the host
+			if size, ok := ctx.rootfsFileSize("sbin/app"); !ok || size != 200 {
+				t.Errorf("sbin/app: got %d, %v; want 200, true", size, ok)
+			}
+			if _, ok := ctx.rootfsFileSize("bin/missing"); ok {
+				t.Errorf("bin/missing reported as present")
+			}
+			if resolved, ok := ctx.lookPath("app", "/bin:/sbin"); !ok || resolved != "/sbin/app" {
+				t.Errorf("lookPath(app): got %q, %v; want /sbin/app, true", resolved, ok)
+			}
+		})
+	}
+}
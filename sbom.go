@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SBOM formats accepted by --sbom
+const (
+	sbomSPDX      = "spdx-json"
+	sbomCycloneDX = "cyclonedx-json"
+)
+
+// sbomPackage is one component found in the rootfs, independent of output format.
+type sbomPackage struct {
+	Name     string
+	Version  string
+	Type     string // deb, apk, rpm, pypi, golang
+	Arch     string
+	License  string
+	Location string // Where in the rootfs it was found
+	PURL     string
+}
+
+// sbomExtension returns the sidecar suffix for a format.
+func sbomExtension(format string) string {
+	if format == sbomCycloneDX {
+		return ".cdx.json"
+	}
+	return ".spdx.json"
+}
+
+// validateSBOMFormat checks the --sbom value.
+func validateSBOMFormat(format string) error {
+	switch format {
+	case "", sbomSPDX, sbomCycloneDX:
+		return nil
+	}
+	return fmt.Errorf("unknown SBOM format %q (use %s or %s)", format, sbomSPDX, sbomCycloneDX)
+}
+
+// readRootfsFile reads a file of the rootfs. Symlinks such as
+// etc/os-release -> ../usr/lib/os-release are followed inside the rootfs,
+// never onto the host.
+func readRootfsFile(rootfs, rel string) ([]byte, error) {
+	p, err := resolveInRoot(rootfs, rel)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// osReleaseID returns the ID field of /etc/os-release in the rootfs, used as the PURL namespace.
+func osReleaseID(rootfs string) string {
+	for _, candidate := range []string{"etc/os-release", "usr/lib/os-release"} {
+		data, err := readRootfsFile(rootfs, candidate)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if value, ok := strings.CutPrefix(line, "ID="); ok {
+				return strings.Trim(value, `"'`)
+			}
+		}
+	}
+	return ""
+}
+
+// parseStanzas splits "Key: value" records separated by blank lines, as
+// used by dpkg status files and Python package metadata headers.
+func parseStanzas(data string, sep string) []map[string]string {
+	var records []map[string]string
+	current := map[string]string{}
+	lastKey := ""
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Buffer(make([]byte, 1<<20), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if len(current) > 0 {
+				records = append(records, current)
+				current = map[string]string{}
+			}
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && lastKey != "" {
+			continue // Continuation line
+		}
+		key, value, ok := strings.Cut(line, sep)
+		if !ok {
+			continue
+		}
+		lastKey = key
+		current[key] = strings.TrimSpace(value)
+	}
+	if len(current) > 0 {
+		records = append(records, current)
+	}
+	return records
+}
+
+// scanDpkg reads /var/lib/dpkg/status and distroless-style status.d entries.
+func scanDpkg(rootfs, distro string) []sbomPackage {
+	files := []string{"var/lib/dpkg/status"}
+	if dir, err := resolveInRoot(rootfs, "var/lib/dpkg/status.d"); err == nil {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			files = append(files, "var/lib/dpkg/status.d/"+entry.Name())
+		}
+	}
+	if distro == "" {
+		distro = "debian"
+	}
+
+	var pkgs []sbomPackage
+	for _, file := range files {
+		if strings.HasSuffix(file, ".md5sums") {
+			continue
+		}
+		data, err := readRootfsFile(rootfs, file)
+		if err != nil {
+			continue
+		}
+		for _, rec := range parseStanzas(string(data), ":") {
+			if rec["Package"] == "" || (rec["Status"] != "" && !strings.HasSuffix(rec["Status"], " installed")) {
+				continue
+			}
+			pkg := sbomPackage{Name: rec["Package"], Version: rec["Version"], Type: "deb", Arch: rec["Architecture"], Location: "/" + file}
+			pkg.PURL = fmt.Sprintf("pkg:deb/%s/%s@%s?arch=%s", distro, pkg.Name, pkg.Version, pkg.Arch)
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	return pkgs
+}
+
+// scanApk reads the Alpine installed database.
+func scanApk(rootfs, distro string) []sbomPackage {
+	data, err := readRootfsFile(rootfs, "lib/apk/db/installed")
+	if err != nil {
+		return nil
+	}
+	if distro == "" {
+		distro = "alpine"
+	}
+	var pkgs []sbomPackage
+	for _, rec := range parseStanzas(string(data), ":") {
+		if rec["P"] == "" {
+			continue
+		}
+		pkg := sbomPackage{Name: rec["P"], Version: rec["V"], Type: "apk", Arch: rec["A"], License: rec["L"], Location: "/lib/apk/db/installed"}
+		pkg.PURL = fmt.Sprintf("pkg:apk/%s/%s@%s?arch=%s", distro, pkg.Name, pkg.Version, pkg.Arch)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// scanRpm queries the rpm database (sqlite or bdb) with the host's rpm tool,
+// since its header format isn't practical to parse here.
+func scanRpm(ctx *ConversionContext, rootfs, distro string) []sbomPackage {
+	dbPath := ""
+	for _, candidate := range []string{"var/lib/rpm", "usr/lib/sysimage/rpm"} {
+		// rpm --root would follow a symlinked database path onto the host
+		resolved, err := resolveInRoot(rootfs, candidate)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(resolved); err == nil {
+			dbPath = "/" + relTo(rootfs, resolved)
+			break
+		}
+	}
+	if dbPath == "" {
+		return nil
+	}
+	if _, err := exec.LookPath("rpm"); err != nil {
+		fmt.Fprintf(os.Stderr, "%s Warning: rpm database found but rpm is not installed; RPM packages are missing from the SBOM\n", colorize("⚠️", "yellow", ctx.NoColor))
+		return nil
+	}
+
+	out, err := exec.Command("rpm", "--root", rootfs, "--dbpath", dbPath, "-qa",
+		"--queryformat", `%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\t%{LICENSE}\t%{EPOCH}\n`).Output()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s Warning: failed to query rpm database: %v\n", colorize("⚠️", "yellow", ctx.NoColor), err)
+		return nil
+	}
+	if distro == "" {
+		distro = "redhat"
+	}
+
+	var pkgs []sbomPackage
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 || fields[0] == "gpg-pubkey" {
+			continue
+		}
+		pkg := sbomPackage{Name: fields[0], Version: fields[1], Type: "rpm", Arch: fields[2], License: fields[3], Location: dbPath}
+		pkg.PURL = fmt.Sprintf("pkg:rpm/%s/%s@%s?arch=%s", distro, pkg.Name, pkg.Version, pkg.Arch)
+		if fields[4] != "(none)" {
+			pkg.PURL += "&epoch=" + fields[4]
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
+
+// pythonPackage reads a .dist-info/METADATA or .egg-info/PKG-INFO file.
+func pythonPackage(rootfs, metadataPath string) (sbomPackage, bool) {
+	data, err := readRootfsFile(rootfs, relTo(rootfs, metadataPath))
+	if err != nil {
+		return sbomPackage{}, false
+	}
+	// Only the header block matters; the description follows the first blank line
+	header, _, _ := strings.Cut(string(data), "\n\n")
+	records := parseStanzas(header, ":")
+	if len(records) == 0 || records[0]["Name"] == "" {
+		return sbomPackage{}, false
+	}
+	rec := records[0]
+	name := strings.ToLower(strings.NewReplacer("_", "-", ".", "-").Replace(rec["Name"]))
+	return sbomPackage{
+		Name:     rec["Name"],
+		Version:  rec["Version"],
+		Type:     "pypi",
+		License:  rec["License"],
+		Location: "/" + relTo(rootfs, filepath.Dir(metadataPath)),
+		PURL:     fmt.Sprintf("pkg:pypi/%s@%s", name, rec["Version"]),
+	}, true
+}
+
+// scanFiles walks the rootfs once for Python package metadata and Go binaries.
+func scanFiles(rootfs string) []sbomPackage {
+	var pkgs []sbomPackage
+	filepath.WalkDir(rootfs, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := relTo(rootfs, p)
+		if d.IsDir() {
+			switch rel {
+			case "proc", "sys", "dev", "run", "tmp":
+				return filepath.SkipDir
+			}
+			name := d.Name()
+			if strings.HasSuffix(name, ".dist-info") {
+				if pkg, ok := pythonPackage(rootfs, filepath.Join(p, "METADATA")); ok {
+					pkgs = append(pkgs, pkg)
+				}
+				return filepath.SkipDir
+			}
+			if strings.HasSuffix(name, ".egg-info") {
+				if pkg, ok := pythonPackage(rootfs, filepath.Join(p, "PKG-INFO")); ok {
+					pkgs = append(pkgs, pkg)
+				}
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Mode().Perm()&0111 == 0 || info.Size() < 1024 {
+			return nil
+		}
+		bi, err := buildinfo.ReadFile(p)
+		if err != nil {
+			return nil // Not a Go binary
+		}
+		location := "/" + rel
+		if bi.Main.Path != "" {
+			pkgs = append(pkgs, sbomPackage{Name: bi.Main.Path, Version: bi.Main.Version, Type: "golang", Location: location,
+				PURL: fmt.Sprintf("pkg:golang/%s@%s", bi.Main.Path, bi.Main.Version)})
+		}
+		pkgs = append(pkgs, sbomPackage{Name: "stdlib", Version: bi.GoVersion, Type: "golang", Location: location,
+			PURL: fmt.Sprintf("pkg:golang/stdlib@%s", bi.GoVersion)})
+		for _, dep := range bi.Deps {
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			pkgs = append(pkgs, sbomPackage{Name: dep.Path, Version: dep.Version, Type: "golang", Location: location,
+				PURL: fmt.Sprintf("pkg:golang/%s@%s", dep.Path, dep.Version)})
+		}
+		return nil
+	})
+	return pkgs
+}
+
+// relTo returns p relative to root with forward slashes.
+func relTo(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+// collectPackages runs every cataloger over the unpacked rootfs.
+func collectPackages(ctx *ConversionContext) []sbomPackage {
+	rootfs := ctx.rootfsPath()
+	distro := osReleaseID(rootfs)
+
+	var pkgs []sbomPackage
+	pkgs = append(pkgs, scanDpkg(rootfs, distro)...)
+	pkgs = append(pkgs, scanApk(rootfs, distro)...)
+	pkgs = append(pkgs, scanRpm(ctx, rootfs, distro)...)
+	pkgs = append(pkgs, scanFiles(rootfs)...)
+
+	// The same Go module or Python package can be found in several places
+	seen := make(map[string]bool)
+	unique := pkgs[:0]
+	for _, pkg := range pkgs {
+		key := pkg.PURL + "|" + pkg.Location
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, pkg)
+		}
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i].PURL < unique[j].PURL })
+	return unique
+}
+
+// newUUID returns a random RFC 4122 version 4 UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// spdxID makes a string safe for use in an SPDX identifier.
+func spdxID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+func buildSPDX(ctx *ConversionContext, pkgs []sbomPackage, created string) any {
+	type externalRef struct {
+		Category string `json:"referenceCategory"`
+		Type     string `json:"referenceType"`
+		Locator  string `json:"referenceLocator"`
+	}
+	type spdxPackage struct {
+		Name             string        `json:"name"`
+		SPDXID           string        `json:"SPDXID"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		LicenseConcluded string        `json:"licenseConcluded"`
+		LicenseDeclared  string        `json:"licenseDeclared"`
+		CopyrightText    string        `json:"copyrightText"`
+		SourceInfo       string        `json:"sourceInfo,omitempty"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+	}
+	type relationship struct {
+		Element string `json:"spdxElementId"`
+		Type    string `json:"relationshipType"`
+		Related string `json:"relatedSpdxElement"`
+	}
+
+	image := spdxPackage{
+		Name: ctx.ImageRef, SPDXID: "SPDXRef-Image", DownloadLocation: "NOASSERTION",
+		LicenseConcluded: "NOASSERTION", LicenseDeclared: "NOASSERTION", CopyrightText: "NOASSERTION",
+	}
+	if ctx.BuildInfo != nil && ctx.BuildInfo.Digest != "" {
+		image.VersionInfo = ctx.BuildInfo.Digest
+	}
+	packages := []spdxPackage{image}
+	relationships := []relationship{{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Image"}}
+
+	for i, pkg := range pkgs {
+		id := fmt.Sprintf("SPDXRef-Package-%s-%s-%d", pkg.Type, spdxID(pkg.Name), i)
+		// Declared licenses from package databases are free text, not SPDX expressions
+		packages = append(packages, spdxPackage{
+			Name: pkg.Name, SPDXID: id, VersionInfo: pkg.Version, DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION", LicenseDeclared: "NOASSERTION", CopyrightText: "NOASSERTION",
+			SourceInfo:   "found in " + pkg.Location,
+			ExternalRefs: []externalRef{{"PACKAGE-MANAGER", "purl", pkg.PURL}},
+		})
+		relationships = append(relationships, relationship{"SPDXRef-Image", "CONTAINS", id})
+	}
+
+	return map[string]any{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              ctx.ImageRef,
+		"documentNamespace": fmt.Sprintf("%s/spdx/%s-%s", fsifyBuilderID, spdxID(ctx.ImageRef), newUUID()),
+		"creationInfo": map[string]any{
+			"created":  created,
+			"creators": []string{"Tool: fsify-" + Version},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+func buildCycloneDX(ctx *ConversionContext, pkgs []sbomPackage, created string) any {
+	type license struct {
+		License struct {
+			Name string `json:"name"`
+		} `json:"license"`
+	}
+	type property struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type component struct {
+		Type       string     `json:"type"`
+		BOMRef     string     `json:"bom-ref"`
+		Name       string     `json:"name"`
+		Version    string     `json:"version,omitempty"`
+		PURL       string     `json:"purl,omitempty"`
+		Licenses   []license  `json:"licenses,omitempty"`
+		Properties []property `json:"properties,omitempty"`
+	}
+
+	image := component{Type: "container", BOMRef: "image", Name: ctx.ImageRef}
+	if ctx.BuildInfo != nil {
+		image.Version = ctx.BuildInfo.Digest
+	}
+
+	var components []component
+	for i, pkg := range pkgs {
+		c := component{
+			Type: "library", BOMRef: fmt.Sprintf("%s#%d", pkg.PURL, i), Name: pkg.Name, Version: pkg.Version, PURL: pkg.PURL,
+			Properties: []property{{"fsify:location", pkg.Location}},
+		}
+		if pkg.Type == "deb" || pkg.Type == "apk" || pkg.Type == "rpm" {
+			c.Type = "application"
+		}
+		if pkg.License != "" {
+			var l license
+			l.License.Name = pkg.License
+			c.Licenses = []license{l}
+		}
+		components = append(components, c)
+	}
+
+	return map[string]any{
+		"bomFormat":    "CycloneDX",
+		"specVersion":  "1.5",
+		"serialNumber": "urn:uuid:" + newUUID(),
+		"version":      1,
+		"metadata": map[string]any{
+			"timestamp": created,
+			"tools": map[string]any{
+				"components": []map[string]string{{"type": "application", "name": "fsify", "version": Version}},
+			},
+			"component": image,
+		},
+		"components": components,
+	}
+}
+
+// generateSBOM catalogs the unpacked rootfs and writes the SBOM to the work
+// directory, embedding a copy in the image when requested.
+func generateSBOM(ctx *ConversionContext) error {
+	pkgs := collectPackages(ctx)
+	created := buildTime(ctx).Format(time.RFC3339)
+
+	var doc any
+	if ctx.SBOMFormat == sbomCycloneDX {
+		doc = buildCycloneDX(ctx, pkgs, created)
+	} else {
+		doc = buildSPDX(ctx, pkgs, created)
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode SBOM: %w", err)
+	}
+	data = append(data, '\n')
+
+	if ctx.Verbose {
+		counts := make(map[string]int)
+		for _, pkg := range pkgs {
+			counts[pkg.Type]++
+		}
+		fmt.Printf("%s Found %d packages %v\n", colorize("│", "blue", ctx.NoColor), len(pkgs), counts)
+	}
+
+	if err := os.WriteFile(ctx.SBOMPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	if ctx.SBOMEmbed {
+		return writeRootfsFile(ctx, "etc/fsify/sbom"+sbomExtension(ctx.SBOMFormat), data, 0644)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSBOMScannersStayInRootfs(t *testing.T) {
+	rootfs := t.TempDir()
+	files := map[string]string{
+		"usr/lib/os-release":             "NAME=\"Alpine Linux\"\nID=alpine\n",
+		"usr/lib/apk/db/installed":       "P:musl\nV:1.2.5-r0\nA:x86_64\nL:MIT\n\n",
+		"usr/share/dpkg/status":          "Package: base-files\nStatus: install ok installed\nVersion: 12.4\nArchitecture: amd64\n\n",
+		"usr/share/dpkg/status.d/tzdata": "Package: tzdata\nVersion: 2024a\nArchitecture: all\n\n",
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(rootfs, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Absolute links resolve against the rootfs, not the host
+	for name, target := range map[string]string{
+		"etc/os-release": "/usr/lib/os-release",
+		"lib":            "/usr/lib",
+		"var/lib/dpkg":   "/usr/share/dpkg",
+	} {
+		if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(rootfs, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if id := osReleaseID(rootfs); id != "alpine" {
+		t.Errorf("osReleaseID = %q, want alpine", id)
+	}
+	apk := scanApk(rootfs, "alpine")
+	if len(apk) != 1 || apk[0].PURL != "pkg:apk/alpine/musl@1.2.5-r0?arch=x86_64" {
+		t.Errorf("scanApk = %+v, want musl", apk)
+	}
+	dpkg := scanDpkg(rootfs, "debian")
+	if len(dpkg) != 2 {
+		t.Fatalf("scanDpkg found %d packages, want 2", len(dpkg))
+	}
+	if dpkg[1].Location != "/var/lib/dpkg/status.d/tzdata" {
+		t.Errorf("tzdata location = %q", dpkg[1].Location)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	cosignSimpleSigningType   = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignArtifactType        = "application/vnd.dev.cosign.artifact.sig.v1+json"
+)
+
+// signaturePolicy is how an image must be signed before it is converted.
+type signaturePolicy struct {
+	Keys       []string // PEM public keys for cosign signatures
+	PolicyFile string   // containers-policy.json, enforced by skopeo
+}
+
+func (p *signaturePolicy) enabled() bool {
+	return len(p.Keys) > 0 || p.PolicyFile != ""
+}
+
+// stringList is a flag that can be given more than once.
+type stringList []string
+
+func (s *stringList) String() string     { return strings.Join(*s, ",") }
+func (s *stringList) Set(v string) error { *s = append(*s, v); return nil }
+
+// simpleSigning is the payload cosign signs.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// signatureManifest is the part of a cosign signature artifact we need.
+type signatureManifest struct {
+	Layers []struct {
+		MediaType   string            `json:"mediaType"`
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"layers"`
+}
+
+// registryLocation returns the registry host and repository path for repo,
+// applying Docker Hub defaults.
+func registryLocation(repo string) (host, path string) {
+	first, rest, ok := strings.Cut(repo, "/")
+	if ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		host, path = first, rest
+	} else {
+		host, path = "registry-1.docker.io", repo
+		if !ok {
+			path = "library/" + repo
+		}
+	}
+	if host == "docker.io" || host == "index.docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return host, path
+}
+
+// downloadSignedImage resolves the image digest in the registry, checks its
+// signatures and then copies exactly that digest, so the content converted
+// is the content that was verified. Nothing is unpacked until this succeeds.
+func downloadSignedImage(ctx *ConversionContext) error {
+	repo, _, _ := splitImageRef(ctx.ImageRef)
+	digest, err := resolveRegistryDigest(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(ctx.Signature.Keys) > 0 {
+		keys, err := loadPublicKeys(ctx.Signature.Keys)
+		if err != nil {
+			return err
+		}
+		if err := verifyCosignSignature(ctx, repo, digest, keys); err != nil {
+			return fmt.Errorf("signature verification failed for %s@%s: %w", repo, digest, err)
+		}
+	}
+
+	args := []string{}
+	if ctx.Signature.PolicyFile != "" {
+		args = append(args, "--policy", ctx.Signature.PolicyFile)
+	}
+	src := fmt.Sprintf("%s@%s", repo, digest)
+	args = append(args, "copy", "docker://"+src, fmt.Sprintf("oci:%s:latest", ctx.OciLayoutPath))
+	err = pullWithCache(ctx, src, func() error { return ctx.runCommand("skopeo", args...) })
+	if err != nil {
+		if ctx.Signature.PolicyFile != "" {
+			return fmt.Errorf("image rejected by signature policy %s: %w", ctx.Signature.PolicyFile, err)
+		}
+		return err
+	}
+
+	ctx.ImageDigest = digest
+	if ctx.Verbose {
+		fmt.Printf("%s Verified signature for %s@%s\n", colorize("│", "green", ctx.NoColor), repo, digest)
+	}
+	return nil
+}
+
+// loadPublicKeys reads PEM encoded ECDSA, RSA or Ed25519 public keys.
+func loadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM public key", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// verifySignature checks a signature over payload with any supported key type.
+func verifySignature(key crypto.PublicKey, payload, sig []byte) bool {
+	digest := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+	return false
+}
+
+// verifyCosignSignature looks for a cosign signature of digest, first under
+// the sha256-<hex>.sig tag and then through the OCI referrers API, and
+// accepts the image if any signature verifies against any of the keys.
+func verifyCosignSignature(ctx *ConversionContext, repo, digest string, keys []crypto.PublicKey) error {
+	sigDir := filepath.Join(filepath.Dir(ctx.OciLayoutPath), "signature")
+	tagRef := fmt.Sprintf("%s:%s.sig", repo, strings.Replace(digest, ":", "-", 1))
+
+	var manifests []signatureManifest
+	var fetchBlob func(digest string) ([]byte, error)
+
+	// Ask the registry for the tag directly first; skopeo covers registries
+	// that need the credentials it knows about
+	client := newRegistryClient(repo)
+	tag := strings.TrimPrefix(tagRef, repo+":")
+	if raw, err := client.get(client.base+"/manifests/"+tag, "application/vnd.oci.image.manifest.v1+json, application/vnd.docker.distribution.manifest.v2+json"); err == nil {
+		var m signatureManifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return fmt.Errorf("invalid signature manifest %s: %w", tagRef, err)
+		}
+		manifests = append(manifests, m)
+		fetchBlob = client.blob
+	} else if raw, err := ctx.commandOutput("skopeo", "inspect", "--raw", "docker://"+tagRef); err == nil {
+		var m signatureManifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return fmt.Errorf("invalid signature manifest %s: %w", tagRef, err)
+		}
+		if err := ctx.runCommand("skopeo", "copy", "docker://"+tagRef, fmt.Sprintf("oci:%s:sig", sigDir)); err != nil {
+			return fmt.Errorf("failed to fetch signature %s: %w", tagRef, err)
+		}
+		manifests = append(manifests, m)
+		fetchBlob = func(d string) ([]byte, error) { return os.ReadFile(ociBlobPath(sigDir, d)) }
+	} else {
+		if ctx.Verbose {
+			fmt.Printf("%s No %s tag, trying the referrers API\n", colorize("│", "yellow", ctx.NoColor), tagRef)
+		}
+		var err error
+		if manifests, err = client.signatureReferrers(digest); err != nil {
+			return err
+		}
+		fetchBlob = client.blob
+	}
+
+	checked := 0
+	for _, m := range manifests {
+		for _, layer := range m.Layers {
+			encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+			if !ok || layer.MediaType != cosignSimpleSigningType {
+				continue
+			}
+			checked++
+			payload, err := fetchBlob(layer.Digest)
+			if err != nil {
+				return fmt.Errorf("failed to fetch signature payload: %w", err)
+			}
+			if actual := sha256.Sum256(payload); "sha256:"+hex.EncodeToString(actual[:]) != layer.Digest {
+				continue
+			}
+			sig, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				continue
+			}
+			var signed simpleSigning
+			if json.Unmarshal(payload, &signed) != nil || signed.Critical.Image.DockerManifestDigest != digest {
+				continue
+			}
+			for _, key := range keys {
+				if verifySignature(key, payload, sig) {
+					return nil
+				}
+			}
+		}
+	}
+	if checked == 0 {
+		return fmt.Errorf("no cosign signatures found")
+	}
+	return fmt.Errorf("none of %d signatures verified with the given keys", checked)
+}
+
+// registryClient talks to the registry API directly for the parts skopeo
+// does not cover. It uses anonymous bearer tokens.
+type registryClient struct {
+	base  string // https://host/v2/path
+	token string
+	http  *http.Client
+}
+
+func newRegistryClient(repo string) *registryClient {
+	host, path := registryLocation(repo)
+	scheme := "https"
+	if isLoopbackHost(host) {
+		scheme = "http"
+	}
+	return &registryClient{
+		base: fmt.Sprintf("%s://%s/v2/%s", scheme, host, path),
+		http: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// isLoopbackHost reports whether a registry host, with an optional port,
+// is this machine. Only those registries are reached over plain http.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// get fetches a registry URL, answering a bearer challenge once.
+func (c *registryClient) get(u, accept string) ([]byte, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return body, nil
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			if err := c.authenticate(resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("GET %s: %s", u, resp.Status)
+		}
+	}
+	return nil, fmt.Errorf("GET %s: unauthorized", u)
+}
+
+// authenticate requests an anonymous token from the realm in a Bearer challenge.
+func (c *registryClient) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported registry authentication %q", scheme)
+	}
+	values := url.Values{}
+	var realm string
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		value = strings.Trim(value, `"`)
+		if key == "realm" {
+			realm = value
+		} else {
+			values.Set(key, value)
+		}
+	}
+	if realm == "" {
+		return fmt.Errorf("registry challenge has no realm")
+	}
+
+	resp, err := c.http.Get(realm + "?" + values.Encode())
+	if err != nil {
+		return fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// signatureReferrers lists cosign signature artifacts that refer to digest.
+func (c *registryClient) signatureReferrers(digest string) ([]signatureManifest, error) {
+	body, err := c.get(fmt.Sprintf("%s/referrers/%s?artifactType=%s", c.base, digest, url.QueryEscape(cosignArtifactType)), "application/vnd.oci.image.index.v1+json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	var index struct {
+		Manifests []struct {
+			Digest       string `json:"digest"`
+			ArtifactType string `json:"artifactType"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, fmt.Errorf("invalid referrers response: %w", err)
+	}
+
+	var manifests []signatureManifest
+	for _, desc := range index.Manifests {
+		// Registries may ignore the artifactType filter
+		if desc.ArtifactType != cosignArtifactType {
+			continue
+		}
+		raw, err := c.get(c.base+"/manifests/"+desc.Digest, "application/vnd.oci.image.manifest.v1+json")
+		if err != nil {
+			return nil, err
+		}
+		var m signatureManifest
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("invalid signature manifest %s: %w", desc.Digest, err)
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+func (c *registryClient) blob(digest string) ([]byte, error) {
+	return c.get(c.base+"/blobs/"+digest, "")
+}
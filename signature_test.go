@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeRegistry serves cosign signature artifacts for one repository, the
+// way a registry does for the .sig tag or the referrers API.
+type fakeRegistry struct {
+	manifests map[string][]byte // By tag or digest
+	blobs     map[string][]byte
+	referrers []byte // Referrers index for the image, nil for 404
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rest, ok := strings.CutPrefix(req.URL.Path, "/v2/test/app/")
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	var body []byte
+	switch kind, ref, _ := strings.Cut(rest, "/"); kind {
+	case "manifests":
+		body = r.manifests[ref]
+	case "blobs":
+		body = r.blobs[ref]
+	case "referrers":
+		body = r.referrers
+	}
+	if body == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write(body)
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// signPayload signs like cosign: ECDSA over the SHA-256 of the payload,
+// Ed25519 over the payload itself.
+func signPayload(t *testing.T, key crypto.Signer, payload []byte) string {
+	t.Helper()
+	var sig []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// writePublicKey writes the public half of key as a PEM file and loads it back.
+func writePublicKey(t *testing.T, key crypto.Signer) crypto.PublicKey {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadPublicKeys([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys[0]
+}
+
+func simpleSigningPayload(t *testing.T, repo, digest string) []byte {
+	t.Helper()
+	var s simpleSigning
+	s.Critical.Identity.DockerReference = repo
+	s.Critical.Image.DockerManifestDigest = digest
+	s.Critical.Type = "cosign container image signature"
+	payload, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestVerifyCosignSignature(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageDigest := sha256Digest([]byte("image manifest"))
+	otherDigest := sha256Digest([]byte("another image manifest"))
+
+	tests := []struct {
+		name      string
+		signer    crypto.Signer
+		verifier  crypto.Signer
+		signed    string // Digest named in the payload
+		referrers bool   // Publish through the referrers API instead of the .sig tag
+		tamper    bool   // Serve a payload blob that differs from its digest
+		unsigned  bool
+		wantErr   string
+	}{
+		{name: "ecdsa tag", signer: ecdsaKey, verifier: ecdsaKey, signed: imageDigest},
+		{name: "ed25519 tag", signer: edKey, verifier: edKey, signed: imageDigest},
+		{name: "ecdsa referrers", signer: ecdsaKey, verifier: ecdsaKey, signed: imageDigest, referrers: true},
+		{name: "ed25519 referrers", signer: edKey, verifier: edKey, signed: imageDigest, referrers: true},
+		{name: "wrong key", signer: ecdsaKey, verifier: otherKey, signed: imageDigest, wantErr: "none of 1 signatures verified"},
+		{name: "wrong key type", signer: edKey, verifier: ecdsaKey, signed: imageDigest, wantErr: "none of 1 signatures verified"},
+		{name: "digest mismatch", signer: ecdsaKey, verifier: ecdsaKey, signed: otherDigest, wantErr: "none of 1 signatures verified"},
+		{name: "tampered payload", signer: ecdsaKey, verifier: ecdsaKey, signed: imageDigest, tamper: true, wantErr: "none of 1 signatures verified"},
+		{name: "no signatures", verifier: ecdsaKey, unsigned: true, wantErr: "no cosign signatures found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+			server := httptest.NewServer(reg)
+			defer server.Close()
+			repo := strings.TrimPrefix(server.URL, "http://") + "/test/app"
+
+			if tt.unsigned {
+				reg.referrers = []byte(`{"schemaVersion":2,"manifests":[]}`)
+			} else {
+				payload := simpleSigningPayload(t, repo, tt.signed)
+				payloadDigest := sha256Digest(payload)
+				reg.blobs[payloadDigest] = payload
+				if tt.tamper {
+					reg.blobs[payloadDigest] = simpleSigningPayload(t, repo+"-evil", tt.signed)
+				}
+				manifest, err := json.Marshal(map[string]any{
+					"schemaVersion": 2,
+					"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+					"artifactType":  cosignArtifactType,
+					"layers": []map[string]any{{
+						"mediaType":   cosignSimpleSigningType,
+						"digest":      payloadDigest,
+						"size":        len(payload),
+						"annotations": map[string]string{cosignSignatureAnnotation: signPayload(t, tt.signer, payload)},
+					}},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.referrers {
+					manifestDigest := sha256Digest(manifest)
+					reg.manifests[manifestDigest] = manifest
+					reg.referrers, _ = json.Marshal(map[string]any{
+						"schemaVersion": 2,
+						"manifests":     []map[string]any{{"digest": manifestDigest, "artifactType": cosignArtifactType}},
+					})
+				} else {
+					reg.manifests[strings.Replace(imageDigest, ":", "-", 1)+".sig"] = manifest
+				}
+			}
+
+			ctx := &ConversionContext{OciLayoutPath: filepath.Join(t.TempDir(), "oci-layout"), NoColor: true}
+			err := verifyCosignSignature(ctx, repo, imageDigest, []crypto.PublicKey{writePublicKey(t, tt.verifier)})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("expected the signature to verify, got %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("expected %q, the signature verified", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIsLoopbackHost(t *testing.T) {
+	for host, want := range map[string]bool{
+		"localhost":            true,
+		"localhost:5000":       true,
+		"127.0.0.1":            true,
+		"127.0.0.1:5000":       true,
+		"[::1]:5000":           true,
+		"::1":                  true,
+		"localhost.evil.com":   false,
+		"127.0.0.1.nip.io":     false,
+		"127.0.0.1.nip.io:443": false,
+		"registry.example":     false,
+		"10.0.0.1:5000":        false,
+	} {
+		if got := isLoopbackHost(host); got != want {
+			t.Errorf("isLoopbackHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a human-readable size such as "512M", "2G" or "1.5GiB"
+// into bytes. Suffixes are binary (K = 1024); a bare number is bytes.
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			str = str[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(value) || value < 0 || value*float64(multiplier) >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 512M, 2G)", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// validateSizeTargets checks that the sizing options can be honored together.
+func validateSizeTargets(ctx *ConversionContext) error {
+	if ctx.FreePercent < 0 || ctx.FreePercent >= 100 {
+		return fmt.Errorf("--free-percent must be between 0 and 100")
+	}
+	if ctx.TargetSize > 0 && (ctx.FreeSpace > 0 || ctx.FreePercent > 0) {
+		return fmt.Errorf("--size cannot be combined with --free-space or --free-percent")
+	}
+	if ctx.FreeSpace > 0 && ctx.FreePercent > 0 {
+		return fmt.Errorf("--free-space and --free-percent are mutually exclusive")
+	}
+	if ctx.FsType == "erofs" && (ctx.TargetSize > 0 || ctx.FreeSpace > 0 || ctx.FreePercent > 0 || ctx.MinInodes > 0) {
+		return fmt.Errorf("erofs images are read-only and sized by their content; sizing options don't apply")
+	}
+	return nil
+}
+
+// withFreeSpace grows a used size so the free-space target holds on top of it.
+func (ctx *ConversionContext) withFreeSpace(used int64) int64 {
+	switch {
+	case ctx.FreeSpace > 0:
+		return used + ctx.FreeSpace
+	case ctx.FreePercent > 0:
+		return int64(float64(used) * 100 / (100 - ctx.FreePercent))
+	}
+	return used
+}
+
+// ext4Info is the subset of the dumpe2fs superblock summary fsify uses.
+type ext4Info struct {
+	BlockCount     int64
+	BlockSize      int64
+	FreeBlocks     int64
+	InodeCount     int64
+	FreeInodes     int64
+	InodesPerGroup int64
+	BlocksPerGroup int64
+}
+
+// readExt4Info parses `dumpe2fs -h` for an ext2/3/4 image.
+func readExt4Info(imagePath string) (*ext4Info, error) {
+	cmd := exec.Command("dumpe2fs", "-h", imagePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get filesystem info: %w", err)
+	}
+
+	info := &ext4Info{}
+	fields := map[string]*int64{
+		"Block count:":      &info.BlockCount,
+		"Block size:":       &info.BlockSize,
+		"Free blocks:":      &info.FreeBlocks,
+		"Inode count:":      &info.InodeCount,
+		"Free inodes:":      &info.FreeInodes,
+		"Inodes per group:": &info.InodesPerGroup,
+		"Blocks per group:": &info.BlocksPerGroup,
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		for prefix, dest := range fields {
+			if strings.HasPrefix(line, prefix) {
+				fmt.Sscanf(strings.TrimSpace(strings.TrimPrefix(line, prefix)), "%d", dest)
+			}
+		}
+	}
+
+	if info.BlockCount == 0 || info.BlockSize == 0 {
+		return nil, fmt.Errorf("failed to parse filesystem size from dumpe2fs")
+	}
+	return info, nil
+}
+
+// ext4TargetBlocks returns the block count a shrunk ext4 filesystem must be
+// grown back to so the free-space and minimum-inode targets hold. Inodes
+// come in whole groups, so the inode target is met by adding groups.
+func (ctx *ConversionContext) ext4TargetBlocks(info *ext4Info) int64 {
+	target := info.BlockCount
+
+	used := (info.BlockCount - info.FreeBlocks) * info.BlockSize
+	if want := ctx.withFreeSpace(used); want > used {
+		target = max(target, blocksFor(want, info.BlockSize))
+	}
+
+	if ctx.MinInodes > info.InodeCount && info.InodesPerGroup > 0 && info.BlocksPerGroup > 0 {
+		groups := (ctx.MinInodes + info.InodesPerGroup - 1) / info.InodesPerGroup
+		target = max(target, groups*info.BlocksPerGroup)
+	}
+	return target
+}
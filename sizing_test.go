@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "512", want: 512},
+		{in: "512M", want: 512 << 20},
+		{in: "2G", want: 2 << 30},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: " 4k ", want: 4 << 10},
+		{in: "0", want: 0},
+		{in: "", wantErr: true},
+		{in: "-1G", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "NaNG", wantErr: true},
+		{in: "Inf", wantErr: true},
+		{in: "+InfM", wantErr: true},
+		{in: "-Inf", wantErr: true},
+		{in: "1e400", wantErr: true},
+		{in: "9000000T", wantErr: true},
+		{in: "big", wantErr: true},
+	} {
+		got, err := parseSize(tt.in)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("parseSize(%q) = %d, want an error", tt.in, got)
+		case !tt.wantErr && (err != nil || got != tt.want):
+			t.Errorf("parseSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
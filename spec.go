@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// buildSpec is the file read by `fsify build -f fsify.yaml`: shared
+// defaults plus a list of images, each overriding any option.
+type buildSpec struct {
+	Defaults yaml.Node   `yaml:"defaults"`
+	Images   []yaml.Node `yaml:"images"`
+}
+
+// specImage is one entry of a build spec.
+type specImage struct {
+	Image          string `yaml:"image"`
+	convertOptions `yaml:",inline"`
+}
+
+// buildReport is the aggregated JSON report of a batch build.
+type buildReport struct {
+	Spec      string        `json:"spec"`
+	Started   string        `json:"started"`
+	Finished  string        `json:"finished"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []buildResult `json:"results"`
+}
+
+type buildResult struct {
+	Image    string  `json:"image"`
+	Success  bool    `json:"success"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"durationSeconds"`
+	*conversionResult
+}
+
+// decodeStrict decodes a YAML node, rejecting unknown keys so typos in a
+// spec fail loudly instead of being ignored.
+func decodeStrict(node *yaml.Node, out any) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
+
+// resolvePaths makes the paths in a spec relative to the spec file.
+func (o *convertOptions) resolvePaths(base string) {
+	resolve := func(path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(base, *path)
+		}
+	}
+	resolve(&o.Output)
+	resolve(&o.OutputDir)
+	resolve(&o.WorkDir)
+	resolve(&o.CacheDir)
+	resolve(&o.CloudInit)
+	resolve(&o.MetaData)
+	resolve(&o.NetworkConfig)
+	resolve(&o.SignaturePolicy)
+	for i := range o.SSHAuthorizedKeys {
+		resolve(&o.SSHAuthorizedKeys[i])
+	}
+	for i := range o.ExcludeFrom {
+		resolve(&o.ExcludeFrom[i])
+	}
+	for i := range o.AddTar {
+		resolve(&o.AddTar[i])
+	}
+	for i := range o.Add {
+		if src, rest, ok := strings.Cut(o.Add[i], ":"); ok {
+			resolve(&src)
+			o.Add[i] = src + ":" + rest
+		}
+	}
+	for i := range o.SignatureKeys {
+		resolve(&o.SignatureKeys[i])
+	}
+}
+
+// loadBuildSpec reads a spec and returns every image with its defaults applied.
+func loadBuildSpec(path string) ([]specImage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build spec: %w", err)
+	}
+	var spec buildSpec
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("failed to parse build spec %s: %w", path, err)
+	}
+
+	defaults := defaultConvertOptions()
+	if !spec.Defaults.IsZero() {
+		if err := decodeStrict(&spec.Defaults, &defaults); err != nil {
+			return nil, fmt.Errorf("invalid defaults in %s: %w", path, err)
+		}
+	}
+	if len(spec.Images) == 0 {
+		return nil, fmt.Errorf("build spec %s lists no images", path)
+	}
+
+	base := filepath.Dir(path)
+	var images []specImage
+	for i := range spec.Images {
+		// Fresh lists so one image's resolved paths cannot alias another's
+		entry := specImage{convertOptions: defaults.clone()}
+		if err := decodeStrict(&spec.Images[i], &entry); err != nil {
+			return nil, fmt.Errorf("invalid image %d in %s: %w", i+1, path, err)
+		}
+		if entry.Image == "" {
+			return nil, fmt.Errorf("image %d in %s has no image reference", i+1, path)
+		}
+		entry.resolvePaths(base)
+		images = append(images, entry)
+	}
+	return images, nil
+}
+
+// runBuild implements `fsify build -f fsify.yaml [--jobs N] [--report FILE]`.
+func runBuild(args []string) int {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	specPath := fs.String("file", "fsify.yaml", "Build spec file")
+	jobs := fs.Int("jobs", 1, "Number of images to build in parallel")
+	reportPath := fs.String("report", "", "Write the JSON report to a file instead of stdout")
+	fs.BoolVar(&verbose, "verbose", false, "Show the full output of each build (with --jobs 1)")
+	fs.BoolVar(&noColor, "no-color", false, "Disable colored output")
+	aliasFlag(fs, "file", "f")
+	aliasFlag(fs, "jobs", "j")
+	aliasFlag(fs, "verbose", "v")
+	fs.Usage = func() {
+		fmt.Println("USAGE:\n    sudo fsify build [-f|--file fsify.yaml] [-j|--jobs N] [--report report.json] [-v|--verbose]")
+	}
+	if len(parseArgs(fs, args)) != 0 || *jobs < 1 {
+		fs.Usage()
+		return 1
+	}
+
+	images, err := loadBuildSpec(*specPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", colorize("❌ Error:", "red", noColor), err)
+		return 1
+	}
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, colorize("Error: This program requires root privileges for mount operations.", "red", false))
+		return 1
+	}
+	if !isTerminal() {
+		noColor = true
+	}
+	for _, image := range images {
+		if err := checkPrerequisites(image.FsType, image.DualOutput, image.Stream); err != nil {
+			fmt.Fprintf(os.Stderr, "%s Error: Missing prerequisites for %s - %v\n", colorize("❌", "red", noColor), image.Image, err)
+			suggestPrerequisiteInstallation()
+			return 1
+		}
+	}
+	// Interleaved progress from parallel builds is unreadable
+	quiet = !verbose || *jobs > 1
+
+	report := buildReport{Spec: *specPath, Started: time.Now().UTC().Format(time.RFC3339)}
+	report.Results = make([]buildResult, len(images))
+	sem := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	var printMu sync.Mutex
+	for i, image := range images {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := time.Now()
+			result, err := createFsFromImage(image.Image, image.convertOptions)
+			r := buildResult{Image: image.Image, Success: err == nil, Duration: time.Since(start).Seconds(), conversionResult: result}
+
+			printMu.Lock()
+			defer printMu.Unlock()
+			if err != nil {
+				r.Error = err.Error()
+				fmt.Fprintf(os.Stderr, "%s %s: %v\n", colorize("❌", "red", noColor), image.Image, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s %s → %s (%.1fs)\n", colorize("✅", "green", noColor), image.Image, result.Image, r.Duration)
+			}
+			report.Results[i] = r
+		}()
+	}
+	wg.Wait()
+
+	report.Finished = time.Now().UTC().Format(time.RFC3339)
+	for _, r := range report.Results {
+		if r.Success {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	if *reportPath != "" {
+		if err := os.WriteFile(*reportPath, append(data, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed to write report: %v\n", colorize("❌ Error:", "red", noColor), err)
+			return 1
+		}
+	} else {
+		fmt.Println(string(data))
+	}
+
+	fmt.Fprintf(os.Stderr, "%s %d of %d images built\n", colorize("📦", "blue", noColor), report.Succeeded, len(images))
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadBuildSpecResolvesDefaultsPerImage(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("specs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	spec := `defaults:
+  add: ["files/motd:/etc/motd"]
+  addTar: [extra.tar]
+  excludeFrom: [exclude.txt]
+  sshAuthorizedKeys: [keys/admin.pub]
+  signatureKeys: [cosign.pub]
+images:
+  - image: alpine:3.20
+  - image: debian:12
+    exclude: [/var/cache]
+`
+	if err := os.WriteFile("specs/fsify.yaml", []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := loadBuildSpec(filepath.Join("specs", "fsify.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2", len(images))
+	}
+	for _, image := range images {
+		for _, tt := range []struct {
+			field string
+			got   stringList
+			want  string
+		}{
+			{"add", image.Add, "specs/files/motd:/etc/motd"},
+			{"addTar", image.AddTar, "specs/extra.tar"},
+			{"excludeFrom", image.ExcludeFrom, "specs/exclude.txt"},
+			{"sshAuthorizedKeys", image.SSHAuthorizedKeys, "specs/keys/admin.pub"},
+			{"signatureKeys", image.SignatureKeys, "specs/cosign.pub"},
+		} {
+			if !slices.Equal(tt.got, stringList{tt.want}) {
+				t.Errorf("%s: %s is %q, want [%q]", image.Image, tt.field, tt.got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// OCI whiteout markers (see the OCI image-spec layer documentation)
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// mergedEntry records which layer provides the final version of a path.
+type mergedEntry struct {
+	Header *tar.Header
+	Layer  int          // Index into mergedTree.Layers
+	Seq    int          // Position of the entry within its layer
+	Source *mergedEntry // For a hard link, the regular file entry holding its data
+}
+
+// mergedTree is the in-memory result of applying all layers and whiteouts,
+// without any file content having been written to disk.
+type mergedTree struct {
+	Layers  []OCDescriptor
+	Entries map[string]*mergedEntry
+	Extra   map[string]*extraFile // Files added by fsify, written after the layers
+	Size    int64                 // Sum of regular file sizes, in bytes
+}
+
+// extraFile is a file fsify adds to the rootfs in stream mode.
+type extraFile struct {
+	Data     []byte
+	Mode     int64
+	Uid, Gid int
+	Linkname string // Symlink target; Data is unused when set
+}
+
+// loadOciIndex reads index.json from an OCI layout.
+func loadOciIndex(layoutPath string) (*OCIIndex, error) {
+	indexData, err := os.ReadFile(filepath.Join(layoutPath, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI index: %w", err)
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(indexData, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse OCI index: %w", err)
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("OCI index contains no manifests")
+	}
+	return &index, nil
+}
+
+// loadOciManifest resolves the image manifest referenced by index.json in an OCI layout.
+func loadOciManifest(layoutPath string) (*OCIManifest, error) {
+	index, err := loadOciIndex(layoutPath)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestData, err := os.ReadFile(ociBlobPath(layoutPath, index.Manifests[0].Digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI manifest: %w", err)
+	}
+	var manifest OCIManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse OCI manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// ociBlobPath maps a digest like "sha256:abc..." to its blob file in an OCI layout.
+func ociBlobPath(layoutPath, digest string) string {
+	algo, hex, found := strings.Cut(digest, ":")
+	if !found {
+		algo, hex = "sha256", digest
+	}
+	return filepath.Join(layoutPath, "blobs", algo, hex)
+}
+
+// openLayer opens a layer blob and returns an uncompressed tar stream.
+// Compression is detected from the blob's magic bytes rather than its media
+// type, since Docker and OCI media types differ for the same content.
+func openLayer(layoutPath string, layer OCDescriptor) (io.ReadCloser, error) {
+	f, err := os.Open(ociBlobPath(layoutPath, layer.Digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer %s: %w", layer.Digest, err)
+	}
+	br := bufio.NewReaderSize(f, 1<<20)
+	magic, _ := br.Peek(4)
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to decompress layer %s: %w", layer.Digest, err)
+		}
+		return &layerReader{Reader: gz, closers: []io.Closer{gz, f}}, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to decompress layer %s: %w", layer.Digest, err)
+		}
+		return &layerReader{Reader: zr, closers: []io.Closer{zr.IOReadCloser(), f}}, nil
+	default:
+		return &layerReader{Reader: br, closers: []io.Closer{f}}, nil
+	}
+}
+
+type layerReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *layerReader) Close() error {
+	for _, c := range r.closers {
+		c.Close()
+	}
+	return nil
+}
+
+// cleanTarPath normalizes a tar entry name to a relative path without a
+// leading "./" or "/". The root directory maps to "".
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// removeLower deletes p and everything below it that came from a layer
+// older than the current one. Entries added by the current layer survive.
+func (t *mergedTree) removeLower(p string, layer int, includeSelf bool) {
+	prefix := p + "/"
+	if p == "" {
+		prefix = ""
+	}
+	for name, entry := range t.Entries {
+		if entry.Layer >= layer {
+			continue
+		}
+		if (includeSelf && name == p) || strings.HasPrefix(name, prefix) {
+			delete(t.Entries, name)
+		}
+	}
+}
+
+// resolve is resolveInRoot for the merged tree: symlinks among the layer
+// entries and added files are followed, absolute targets from the tree
+// root, and the resolved tree path is returned ("" for the root).
+func (t *mergedTree) resolve(rel string) (string, error) {
+	var resolved []string
+	pending := strings.Split(cleanTarPath(rel), "/")
+	for links := 0; len(pending) > 0; {
+		name := pending[0]
+		pending = pending[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		target, ok := t.symlinkTarget(path.Join(append(resolved, name)...))
+		if !ok {
+			resolved = append(resolved, name)
+			continue
+		}
+		if links++; links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links in /%s", rel)
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return path.Join(resolved...), nil
+}
+
+// resolveParent resolves the directories of p, so a file added under a
+// symlinked directory like sbin lands at its real path, usr/sbin.
+func (t *mergedTree) resolveParent(p string) (string, error) {
+	parent, err := t.resolve(path.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(parent, path.Base(p)), nil
+}
+
+// symlinkTarget returns the target of p when it is a symlink in the tree.
+func (t *mergedTree) symlinkTarget(p string) (string, bool) {
+	if extra, ok := t.Extra[p]; ok {
+		return extra.Linkname, extra.Linkname != ""
+	}
+	if entry, ok := t.Entries[p]; ok && entry.Header.Typeflag == tar.TypeSymlink {
+		return entry.Header.Linkname, true
+	}
+	return "", false
+}
+
+// mergeOciLayers reads every layer header in order, applying whiteouts, to
+// build the final filesystem tree in memory.
+func mergeOciLayers(ctx *ConversionContext) error {
+	manifest, err := loadOciManifest(ctx.OciLayoutPath)
+	if err != nil {
+		return err
+	}
+
+	// Overlay blobs are linked into the base layout, so their layers simply follow
+	tree := &mergedTree{
+		Layers:  append(manifest.Layers, ctx.overlayLayers()...),
+		Entries: make(map[string]*mergedEntry),
+		Extra:   make(map[string]*extraFile),
+	}
+
+	for i, layer := range tree.Layers {
+		rc, err := openLayer(ctx.OciLayoutPath, layer)
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(rc)
+		seq := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rc.Close()
+				return fmt.Errorf("failed to read layer %s: %w", layer.Digest, err)
+			}
+			seq++
+
+			name := cleanTarPath(hdr.Name)
+			dir, base := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+
+			if base == whiteoutOpaque {
+				tree.removeLower(dir, i, false)
+				continue
+			}
+			if strings.HasPrefix(base, whiteoutPrefix) {
+				tree.removeLower(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), i, true)
+				continue
+			}
+			if name == "" {
+				continue
+			}
+
+			// A non-directory replaces whatever tree was below it
+			if existing, ok := tree.Entries[name]; ok && existing.Header.Typeflag == tar.TypeDir && hdr.Typeflag != tar.TypeDir {
+				tree.removeLower(name, i, false)
+			}
+
+			hdr.Name = name
+			entry := &mergedEntry{Header: hdr, Layer: i, Seq: seq}
+			if hdr.Typeflag == tar.TypeLink {
+				// Remember where the data is, in case its path goes away later
+				if target, ok := tree.Entries[cleanTarPath(hdr.Linkname)]; ok {
+					switch target.Header.Typeflag {
+					case tar.TypeReg:
+						entry.Source = target
+					case tar.TypeLink:
+						entry.Source = target.Source
+					}
+				}
+			}
+			tree.Entries[name] = entry
+		}
+		rc.Close()
+
+		if ctx.Verbose {
+			fmt.Printf("%s Merged layer %d/%d (%s)\n", colorize("│", "cyan", ctx.NoColor), i+1, len(tree.Layers), layer.Digest)
+		}
+	}
+
+	for _, entry := range tree.Entries {
+		if entry.Header.Typeflag == tar.TypeReg {
+			tree.Size += entry.Header.Size
+		}
+	}
+
+	if ctx.Verbose {
+		fmt.Printf("%s Merged tree: %d entries, %d bytes of file data\n", colorize("│", "blue", ctx.NoColor), len(tree.Entries), tree.Size)
+	}
+
+	ctx.Merged = tree
+	return nil
+}
+
+// hardLinks returns the hard links to write, in order, pointed at the path
+// that holds their data. When a link's original target was whited out,
+// replaced or pruned, the first surviving link of that file takes its place
+// as a regular file, like it keeps the inode in an unpacked rootfs; promoted
+// maps each such data entry to that path. A link with no data is an error.
+func (t *mergedTree) hardLinks() ([]string, map[*mergedEntry]string, error) {
+	var names []string
+	for name, entry := range t.Entries {
+		if entry.Header.Typeflag == tar.TypeLink {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var links []string
+	promoted := make(map[*mergedEntry]string)
+	for _, name := range names {
+		entry := t.Entries[name]
+		source := entry.Source
+		if source == nil {
+			return nil, nil, fmt.Errorf("hard link /%s points to /%s, which holds no file data", name, cleanTarPath(entry.Header.Linkname))
+		}
+		switch target, ok := promoted[source]; {
+		case t.Entries[source.Header.Name] == source:
+			entry.Header.Linkname = source.Header.Name
+		case ok:
+			entry.Header.Linkname = target
+		default:
+			promoted[source] = name
+			continue
+		}
+		links = append(links, name)
+	}
+	return links, promoted, nil
+}
+
+// writeMergedTar writes the merged tree as a single tar stream. Directories
+// are emitted first so every parent exists before its children, then each
+// layer is re-read once and only its surviving entries are copied through,
+// and hard links are emitted last once all their targets are present.
+func writeMergedTar(ctx *ConversionContext, w io.Writer, progress io.Writer) error {
+	tree := ctx.Merged
+	tw := tar.NewWriter(w)
+
+	var dirs []string
+	for name, entry := range tree.Entries {
+		if entry.Header.Typeflag == tar.TypeDir {
+			dirs = append(dirs, name)
+		}
+	}
+	links, promoted, err := tree.hardLinks()
+	if err != nil {
+		return err
+	}
+	// Promoted links are written where the layer holds their data
+	type position struct{ layer, seq int }
+	promotedAt := make(map[position]*mergedEntry)
+	for source := range promoted {
+		promotedAt[position{source.Layer, source.Seq}] = source
+	}
+
+	// Parent directories of added files that no layer provides
+	var extras []string
+	for name := range tree.Extra {
+		extras = append(extras, name)
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := tree.Entries[dir]; !ok {
+				tree.Entries[dir] = &mergedEntry{Header: &tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}, Layer: -1}
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	sort.Strings(extras)
+
+	for _, name := range dirs {
+		if err := tw.WriteHeader(tree.Entries[name].Header); err != nil {
+			return fmt.Errorf("failed to write directory %s: %w", name, err)
+		}
+	}
+
+	for i, layer := range tree.Layers {
+		rc, err := openLayer(ctx.OciLayoutPath, layer)
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(rc)
+		seq := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				rc.Close()
+				return fmt.Errorf("failed to read layer %s: %w", layer.Digest, err)
+			}
+			seq++
+
+			if source, ok := promotedAt[position{i, seq}]; ok {
+				name := promoted[source]
+				file := *source.Header
+				file.Name = name
+				if err := tw.WriteHeader(&file); err != nil {
+					rc.Close()
+					return fmt.Errorf("failed to write %s: %w", name, err)
+				}
+				if _, err := io.Copy(tw, tr); err != nil {
+					rc.Close()
+					return fmt.Errorf("failed to copy %s: %w", name, err)
+				}
+				continue
+			}
+
+			entry, ok := tree.Entries[cleanTarPath(hdr.Name)]
+			if !ok || entry.Layer != i || entry.Seq != seq {
+				continue
+			}
+			if entry.Header.Typeflag == tar.TypeDir || entry.Header.Typeflag == tar.TypeLink {
+				continue
+			}
+
+			if err := tw.WriteHeader(entry.Header); err != nil {
+				rc.Close()
+				return fmt.Errorf("failed to write %s: %w", entry.Header.Name, err)
+			}
+			if entry.Header.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(io.MultiWriter(tw, progress), tr); err != nil {
+					rc.Close()
+					return fmt.Errorf("failed to copy %s: %w", entry.Header.Name, err)
+				}
+			}
+		}
+		rc.Close()
+	}
+
+	for _, name := range links {
+		hdr := tree.Entries[name].Header
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write hard link %s: %w", name, err)
+		}
+	}
+
+	for _, name := range extras {
+		file := tree.Extra[name]
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: file.Mode, Uid: file.Uid, Gid: file.Gid, Size: int64(len(file.Data))}
+		if file.Linkname != "" {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, file.Linkname, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		if _, err := tw.Write(file.Data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// runWithMergedTar runs a command with the merged tree piped to its stdin.
+func (ctx *ConversionContext) runWithMergedTar(progress io.Writer, name string, args ...string) error {
+	pr, pw := io.Pipe()
+	writeErr := make(chan error, 1)
+	go func() {
+		err := writeMergedTar(ctx, pw, progress)
+		pw.CloseWithError(err)
+		writeErr <- err
+	}()
+
+	cmdErr := ctx.runCommandWithInput(pr, name, args...)
+	// Unblock the writer if the command exited without draining the stream
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err := <-writeErr; err != nil && err != io.ErrClosedPipe {
+		return fmt.Errorf("failed to stream merged layers: %w", err)
+	}
+	return cmdErr
+}
+
+// streamLayersToFilesystem builds the primary filesystem directly from the
+// merged tar stream, without an unpacked rootfs or a loop mount.
+func streamLayersToFilesystem(ctx *ConversionContext) error {
+	bar := newCopyProgressBar(ctx, ctx.Merged.Size, "Streaming layers into filesystem")
+	defer bar.Finish()
+
+	switch ctx.FsType {
+	case "ext4":
+		// mke2fs reads a tarball for -d when built with libarchive (e2fsprogs >= 1.47.1)
+		args := append([]string{"-F", "-d", "/dev/stdin"}, ctx.FsOptions.mkfsArgs("ext4")...)
+		args = append(args, ctx.ImagePath)
+		if ctx.Estimate != nil && ctx.FsOptions.InodeRatio == 0 {
+			args = append([]string{"-N", strconv.FormatInt(ctx.Estimate.Inodes, 10)}, args...)
+		}
+		return ctx.runWithMergedTar(bar, "mkfs.ext4", args...)
+	case "erofs":
+		args := append([]string{"--tar=f"}, ctx.FsOptions.mkfsArgs("erofs")...)
+		return ctx.runWithMergedTar(bar, "mkfs.erofs", append(args, ctx.ImagePath, "/dev/stdin")...)
+	default:
+		return fmt.Errorf("streaming mode does not support filesystem type %q (use ext4 or erofs)", ctx.FsType)
+	}
+}
+
+// streamSquashfsImage builds the squashfs image from the same merged stream.
+func streamSquashfsImage(ctx *ConversionContext) error {
+	return ctx.runWithMergedTar(io.Discard, "mksquashfs", "-", ctx.SquashfsPath, "-tar", "-noappend")
+}
+
+// writeRootfsFile adds a file to the image's root filesystem. In stream mode
+// it is queued on the merged tree, replacing any layer entry at that path;
+// otherwise it is written into the unpacked rootfs.
+func writeRootfsFile(ctx *ConversionContext, relPath string, data []byte, mode os.FileMode) error {
+	relPath = cleanTarPath(relPath)
+	if ctx.Merged != nil {
+		relPath, err := ctx.Merged.resolveParent(relPath)
+		if err != nil {
+			return err
+		}
+		delete(ctx.Merged.Entries, relPath)
+		ctx.Merged.Extra[relPath] = &extraFile{Data: data, Mode: int64(mode.Perm())}
+		return nil
+	}
+
+	// Parent symlinks are followed inside the rootfs, never onto the host
+	parent, err := resolveInRoot(ctx.rootfsPath(), path.Dir(relPath))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("failed to create directory for /%s: %w", relPath, err)
+	}
+	dest := filepath.Join(parent, path.Base(relPath))
+	// Never write through a symlink planted by the image
+	if info, err := os.Lstat(dest); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(dest, data, mode); err != nil {
+		return fmt.Errorf("failed to write /%s: %w", relPath, err)
+	}
+	return os.Chmod(dest, mode)
+}
+
+// writeRootfsSymlink creates a symlink in the rootfs, or adds it to the
+// merged tree in stream mode, replacing any file at relPath.
+func writeRootfsSymlink(ctx *ConversionContext, relPath, target string) error {
+	relPath = cleanTarPath(relPath)
+	if ctx.Merged != nil {
+		relPath, err := ctx.Merged.resolveParent(relPath)
+		if err != nil {
+			return err
+		}
+		delete(ctx.Merged.Entries, relPath)
+		ctx.Merged.Extra[relPath] = &extraFile{Mode: 0777, Linkname: target}
+		return nil
+	}
+
+	parent, err := resolveInRoot(ctx.rootfsPath(), path.Dir(relPath))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("failed to create directory for /%s: %w", relPath, err)
+	}
+	dest := filepath.Join(parent, path.Base(relPath))
+	if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace /%s: %w", relPath, err)
+	}
+	if err := os.Symlink(target, dest); err != nil {
+		return fmt.Errorf("failed to create /%s: %w", relPath, err)
+	}
+	return nil
+}
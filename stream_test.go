@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeOciLayout writes an OCI layout whose image has one uncompressed
+// layer per list of headers. Regular files get their name as content.
+func writeOciLayout(t *testing.T, layers ...[]*tar.Header) string {
+	t.Helper()
+	layout := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeBlob := func(data []byte) OCDescriptor {
+		desc := OCDescriptor{Digest: sha256Digest(data), Size: int64(len(data))}
+		if err := os.WriteFile(ociBlobPath(layout, desc.Digest), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+
+	var manifest OCIManifest
+	manifest.Config = writeBlob([]byte(`{"architecture":"amd64","os":"linux"}`))
+	for _, headers := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range headers {
+			if hdr.Typeflag == tar.TypeReg {
+				hdr.Size = int64(len(hdr.Name))
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				tw.Write([]byte(hdr.Name))
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers = append(manifest.Layers, writeBlob(buf.Bytes()))
+	}
+	data, _ := json.Marshal(manifest)
+	index, _ := json.Marshal(OCIIndex{Manifests: []OCDescriptor{writeBlob(data)}})
+	if err := os.WriteFile(filepath.Join(layout, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return layout
+}
+
+func TestWriteMergedTarKeepsLinksToRemovedFiles(t *testing.T) {
+	layout := writeOciLayout(t,
+		[]*tar.Header{
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/bin/python3.12", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "usr/bin/python3", Typeflag: tar.TypeLink, Linkname: "usr/bin/python3.12"},
+			{Name: "usr/bin/python", Typeflag: tar.TypeLink, Linkname: "usr/bin/python3"},
+			{Name: "usr/bin/kept", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "usr/bin/kept-link", Typeflag: tar.TypeLink, Linkname: "usr/bin/kept"},
+		},
+		[]*tar.Header{
+			{Name: "usr/bin/.wh.python3.12", Typeflag: tar.TypeReg},
+		},
+	)
+	ctx := &ConversionContext{OciLayoutPath: layout, NoColor: true}
+	if err := mergeOciLayers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeMergedTar(ctx, &buf, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, _ := io.ReadAll(tr)
+			got[hdr.Name] = "file " + string(data)
+		case tar.TypeLink:
+			got[hdr.Name] = "link " + hdr.Linkname
+		}
+	}
+	want := map[string]string{
+		// The first surviving link carries the whited-out file's data
+		"usr/bin/python":    "file usr/bin/python3.12",
+		"usr/bin/python3":   "link usr/bin/python",
+		"usr/bin/kept":      "file usr/bin/kept",
+		"usr/bin/kept-link": "link usr/bin/kept",
+	}
+	for name, w := range want {
+		if got[name] != w {
+			t.Errorf("%s: got %q, want %q", name, got[name], w)
+		}
+	}
+	if _, ok := got["usr/bin/python3.12"]; ok {
+		t.Errorf("whited-out usr/bin/python3.12 was written")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// systemdMasked are units that get in the way when a container image with
+// systemd boots as a VM: they block boot waiting for input or a network
+// nobody configured, or start package downloads behind the service's back.
+var systemdMasked = []string{
+	"systemd-firstboot.service",
+	"systemd-networkd-wait-online.service",
+	"NetworkManager-wait-online.service",
+	"apt-daily.timer",
+	"apt-daily-upgrade.timer",
+	"dnf-makecache.timer",
+	"motd-news.timer",
+}
+
+// systemdUnitDirs are where distributions install unit files.
+var systemdUnitDirs = []string{"usr/lib/systemd/system", "lib/systemd/system"}
+
+// findSystemdUnit returns the guest path of a unit shipped by the image.
+func findSystemdUnit(ctx *ConversionContext, unit string) (string, bool) {
+	for _, dir := range systemdUnitDirs {
+		if _, ok := ctx.rootfsFileSize(path.Join(dir, unit)); ok {
+			return "/" + path.Join(dir, unit), true
+		}
+	}
+	return "", false
+}
+
+// enableSystemdInit keeps the image's systemd as init and wires the service
+// generated from the image config into it: fsify-app.service is enabled
+// through a multi-user.target wants symlink, units that misbehave in a VM
+// are masked, and multi-user.target becomes the default target.
+func enableSystemdInit(ctx *ConversionContext) error {
+	if !hasSystemd(ctx) {
+		return fmt.Errorf("--init systemd: the image has no /usr/lib/systemd/systemd")
+	}
+	rt := ctx.Runtime
+	if rt == nil {
+		rt = &runtimeTranslation{}
+		ctx.Runtime = rt
+	}
+	rt.Init = "systemd"
+
+	// The kernel starts /sbin/init; some images only ship systemd itself
+	if _, ok := ctx.rootfsFileSize("sbin/init"); !ok {
+		target := "/lib/systemd/systemd"
+		if _, ok := ctx.rootfsFileSize("usr/lib/systemd/systemd"); ok {
+			target = "/usr/lib/systemd/systemd"
+		}
+		if err := writeRootfsSymlink(ctx, "sbin/init", target); err != nil {
+			return err
+		}
+	}
+
+	if rt.Service == runtimeUnitPath {
+		if err := writeRootfsSymlink(ctx, "etc/systemd/system/multi-user.target.wants/fsify-app.service", runtimeUnitPath); err != nil {
+			return err
+		}
+	} else {
+		rt.warn("no fsify-app.service was generated, so systemd starts no service of the image")
+	}
+
+	for _, unit := range systemdMasked {
+		if _, ok := findSystemdUnit(ctx, unit); !ok {
+			continue
+		}
+		if err := writeRootfsSymlink(ctx, path.Join("etc/systemd/system", unit), "/dev/null"); err != nil {
+			return err
+		}
+		rt.Masked = append(rt.Masked, unit)
+	}
+
+	target, ok := findSystemdUnit(ctx, "multi-user.target")
+	if !ok {
+		return fmt.Errorf("--init systemd: the image has no multi-user.target")
+	}
+	if err := writeRootfsSymlink(ctx, "etc/systemd/system/default.target", target); err != nil {
+		return err
+	}
+
+	if ctx.Verbose {
+		enabled := "no service"
+		if rt.Service == runtimeUnitPath {
+			enabled = path.Base(runtimeUnitPath)
+		}
+		fmt.Printf("%s systemd: enabled %s, masked %v, default target %s\n", colorize("│", "blue", ctx.NoColor), enabled, rt.Masked, target)
+	}
+	return nil
+}
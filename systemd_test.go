@@ -0,0 +1,66 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnableSystemdInitUsrMerged(t *testing.T) {
+	contexts := usrMergedContexts(t)
+
+	tree := contexts["stream"].Merged
+	for name, hdr := range map[string]*tar.Header{
+		"usr/lib":                                  {Typeflag: tar.TypeDir},
+		"usr/lib/systemd":                          {Typeflag: tar.TypeDir},
+		"usr/lib/systemd/systemd":                  {Typeflag: tar.TypeReg, Size: 300},
+		"usr/lib/systemd/system":                   {Typeflag: tar.TypeDir},
+		"usr/lib/systemd/system/multi-user.target": {Typeflag: tar.TypeReg, Size: 10},
+		"lib": {Typeflag: tar.TypeSymlink, Linkname: "usr/lib"},
+	} {
+		hdr.Name = name
+		tree.Entries[name] = &mergedEntry{Header: hdr}
+	}
+
+	root := contexts["unpacked"].rootfsPath()
+	if err := os.MkdirAll(filepath.Join(root, "usr/lib/systemd/system"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"usr/lib/systemd/systemd", "usr/lib/systemd/system/multi-user.target"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("usr/lib", filepath.Join(root, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	for mode, ctx := range contexts {
+		t.Run(mode, func(t *testing.T) {
+			if err := enableSystemdInit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if ctx.Merged != nil {
+				if _, ok := ctx.Merged.Extra["sbin/init"]; ok {
+					t.Errorf("sbin/init was added under the sbin symlink")
+				}
+				if extra, ok := ctx.Merged.Extra["usr/sbin/init"]; !ok || extra.Linkname != "/usr/lib/systemd/systemd" {
+					t.Errorf("usr/sbin/init: got %+v, want a link to /usr/lib/systemd/systemd", extra)
+				}
+				if _, ok := ctx.Merged.Entries["sbin"]; !ok {
+					t.Errorf("the sbin symlink was replaced")
+				}
+				return
+			}
+			info, err := os.Lstat(filepath.Join(root, "sbin"))
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Fatalf("the sbin symlink was replaced: %v", err)
+			}
+			target, err := os.Readlink(filepath.Join(root, "usr/sbin/init"))
+			if err != nil || target != "/usr/lib/systemd/systemd" {
+				t.Errorf("usr/sbin/init: got %q, %v; want a link to /usr/lib/systemd/systemd", target, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// accessConfig is the login access provisioned into the image.
+type accessConfig struct {
+	User             string   `json:"user,omitempty"`    // Created if missing; receives the SSH keys
+	SSHKeys          []string `json:"sshKeys,omitempty"` // Files with authorized_keys lines
+	RootPasswordHash string   `json:"-"`                 // crypt(3) hash; never recorded
+	RootPassword     bool     `json:"rootPassword,omitempty"`
+}
+
+// newAccessConfig validates the provisioning options.
+func newAccessConfig(opts convertOptions) (*accessConfig, error) {
+	if opts.User == "" && len(opts.SSHAuthorizedKeys) == 0 && opts.RootPasswordHash == "" {
+		return nil, nil
+	}
+	a := &accessConfig{User: opts.User, SSHKeys: opts.SSHAuthorizedKeys, RootPasswordHash: opts.RootPasswordHash}
+	if a.User != "" && !validUserName(a.User) {
+		return nil, fmt.Errorf("invalid --user %q", a.User)
+	}
+	for _, file := range a.SSHKeys {
+		if _, err := os.Stat(file); err != nil {
+			return nil, fmt.Errorf("invalid --ssh-authorized-key: %w", err)
+		}
+	}
+	if h := a.RootPasswordHash; h != "" {
+		// Only hashes, so a plain password never ends up in shell history or the image
+		if !strings.HasPrefix(h, "$") || strings.Count(h, "$") < 3 || strings.ContainsAny(h, ": \n") {
+			return nil, fmt.Errorf("--root-password-hash must be a crypt(3) hash such as $6$... or $y$... (see mkpasswd)")
+		}
+		a.RootPassword = true
+	}
+	return a, nil
+}
+
+// validUserName follows the useradd default: lowercase letters, digits,
+// underscores and hyphens, not starting with a digit or hyphen.
+func validUserName(name string) bool {
+	if len(name) == 0 || len(name) > 32 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c == '_':
+		case (c >= '0' && c <= '9') || c == '-':
+			if i == 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// provisionAccess edits /etc/passwd, /etc/shadow and /etc/group in the
+// unpacked rootfs, creating them if the image has none, and installs the
+// SSH keys for --user, or root without one.
+func provisionAccess(ctx *ConversionContext) error {
+	a := ctx.Access
+	root := ctx.rootfsPath()
+	days := strconv.FormatInt(buildTime(ctx).Unix()/86400, 10)
+
+	passwd, err := readAccountFile(root, "etc/passwd")
+	if err != nil {
+		return err
+	}
+	shadow, err := readAccountFile(root, "etc/shadow")
+	if err != nil {
+		return err
+	}
+	group, err := readAccountFile(root, "etc/group")
+	if err != nil {
+		return err
+	}
+
+	// Distroless images may have no root entries at all
+	if passwd.find("root") == nil {
+		passwd.add([]string{"root", "x", "0", "0", "root", "/root", loginShell(root)})
+	}
+	if group.find("root") == nil {
+		group.add([]string{"root", "x", "0", ""})
+	}
+	if shadow.find("root") == nil {
+		shadow.add([]string{"root", "*", days, "0", "99999", "7", "", "", ""})
+	}
+	if a.RootPasswordHash != "" {
+		entry := shadow.find("root")
+		for len(entry) < 9 {
+			entry = append(entry, "")
+		}
+		entry[1], entry[2] = a.RootPasswordHash, days
+		shadow.replace(entry)
+		// A password is no use with a nologin shell
+		if rootEntry := passwd.find("root"); len(rootEntry) == 7 && !isLoginShell(rootEntry[6]) {
+			rootEntry[6] = loginShell(root)
+		}
+	}
+
+	keyOwner := passwd.find("root")
+	if a.User != "" {
+		keyOwner = passwd.find(a.User)
+		if keyOwner == nil {
+			uid := passwd.nextID()
+			gid := uid
+			if g := group.find(a.User); g != nil {
+				if len(g) < 4 {
+					return fmt.Errorf("malformed /etc/group entry for %s: %q", a.User, strings.Join(g, ":"))
+				}
+				var err error
+				if gid, err = strconv.Atoi(g[2]); err != nil {
+					return fmt.Errorf("invalid gid in /etc/group entry for %s: %w", a.User, err)
+				}
+			} else {
+				if group.hasID(gid) {
+					gid = group.nextID()
+				}
+				group.add([]string{a.User, "x", strconv.Itoa(gid), ""})
+			}
+			keyOwner = passwd.add([]string{a.User, "x", strconv.Itoa(uid), strconv.Itoa(gid), a.User, "/home/" + a.User, loginShell(root)})
+			// "*" has no valid password but, unlike "!", leaves key logins open
+			shadow.add([]string{a.User, "*", days, "0", "99999", "7", "", "", ""})
+			if ctx.Verbose {
+				fmt.Printf("%s Created user %s (%d:%d)\n", colorize("│", "blue", ctx.NoColor), a.User, uid, gid)
+			}
+		}
+	}
+
+	// Entries from the image are used as they are, so check them first
+	owner := a.User
+	if owner == "" {
+		owner = "root"
+	}
+	if len(keyOwner) < 7 {
+		return fmt.Errorf("malformed /etc/passwd entry for %s: %q", owner, strings.Join(keyOwner, ":"))
+	}
+	uid, err := strconv.Atoi(keyOwner[2])
+	if err != nil {
+		return fmt.Errorf("invalid uid in /etc/passwd entry for %s: %w", owner, err)
+	}
+	gid, err := strconv.Atoi(keyOwner[3])
+	if err != nil {
+		return fmt.Errorf("invalid gid in /etc/passwd entry for %s: %w", owner, err)
+	}
+	home := keyOwner[5]
+
+	if err := passwd.write(root, 0644); err != nil {
+		return err
+	}
+	if err := group.write(root, 0644); err != nil {
+		return err
+	}
+	if err := shadow.write(root, 0600); err != nil {
+		return err
+	}
+	if err := createHome(root, home, uid, gid); err != nil {
+		return err
+	}
+	if len(a.SSHKeys) > 0 {
+		if err := installAuthorizedKeys(root, home, uid, gid, a.SSHKeys); err != nil {
+			return err
+		}
+		if ctx.Verbose {
+			fmt.Printf("%s Installed SSH keys for %s in %s/.ssh/authorized_keys\n", colorize("│", "blue", ctx.NoColor), keyOwner[0], home)
+		}
+	}
+	return nil
+}
+
+// accountFile is /etc/passwd, /etc/shadow or /etc/group as colon-separated
+// fields. Lines that are not entries (comments, NIS "+" lines) are kept as is.
+type accountFile struct {
+	rel     string
+	entries [][]string
+}
+
+func readAccountFile(root, rel string) (*accountFile, error) {
+	f := &accountFile{rel: rel}
+	p, err := resolveInRoot(root, rel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /%s: %w", rel, err)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line != "" {
+			f.entries = append(f.entries, strings.Split(line, ":"))
+		}
+	}
+	return f, nil
+}
+
+// find returns the entry for name, or nil.
+func (f *accountFile) find(name string) []string {
+	for _, entry := range f.entries {
+		if entry[0] == name {
+			return entry
+		}
+	}
+	return nil
+}
+
+// replace swaps in entry for the one with the same name.
+func (f *accountFile) replace(entry []string) {
+	for i := range f.entries {
+		if f.entries[i][0] == entry[0] {
+			f.entries[i] = entry
+		}
+	}
+}
+
+func (f *accountFile) add(entry []string) []string {
+	f.entries = append(f.entries, entry)
+	return entry
+}
+
+// hasID reports whether any entry uses id as its uid or gid.
+func (f *accountFile) hasID(id int) bool {
+	for _, entry := range f.entries {
+		if len(entry) > 2 && entry[2] == strconv.Itoa(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextID returns the first regular-user ID (1000 and up) above every one in use.
+func (f *accountFile) nextID() int {
+	next := 1000
+	for _, entry := range f.entries {
+		if len(entry) <= 2 {
+			continue
+		}
+		if id, err := strconv.Atoi(entry[2]); err == nil && id >= next && id < 60000 {
+			next = id + 1
+		}
+	}
+	return next
+}
+
+// write replaces the file, keeping the owner and mode of an existing one.
+func (f *accountFile) write(root string, mode os.FileMode) error {
+	var b strings.Builder
+	for _, entry := range f.entries {
+		b.WriteString(strings.Join(entry, ":"))
+		b.WriteByte('\n')
+	}
+	p, err := resolveInRoot(root, f.rel)
+	if err != nil {
+		return err
+	}
+	uid, gid := 0, 0
+	if info, err := os.Stat(p); err == nil {
+		mode = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create /%s: %w", path.Dir(f.rel), err)
+	}
+	// Write a new file and rename it, so a hard link into the image is never modified
+	tmp := p + ".fsify"
+	if err := os.WriteFile(tmp, []byte(b.String()), mode); err != nil {
+		return fmt.Errorf("failed to write /%s: %w", f.rel, err)
+	}
+	if err := os.Chown(tmp, uid, gid); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write /%s: %w", f.rel, err)
+	}
+	return nil
+}
+
+// isLoginShell reports whether shell allows interactive logins.
+func isLoginShell(shell string) bool {
+	switch path.Base(shell) {
+	case "nologin", "false", "":
+		return false
+	}
+	return true
+}
+
+// loginShell picks bash if the image has it, then sh.
+func loginShell(root string) string {
+	for _, shell := range []string{"/bin/bash", "/bin/sh"} {
+		if p, err := resolveInRoot(root, shell); err == nil {
+			if _, err := os.Stat(p); err == nil {
+				return shell
+			}
+		}
+	}
+	return "/bin/sh"
+}
+
+// createHome creates a home directory owned by the user if it is missing.
+func createHome(root, home string, uid, gid int) error {
+	p, err := resolveInRoot(root, home)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create home directory %s: %w", home, err)
+	}
+	if err := os.Mkdir(p, 0700); err != nil {
+		return fmt.Errorf("failed to create home directory %s: %w", home, err)
+	}
+	return os.Chown(p, uid, gid)
+}
+
+// installAuthorizedKeys adds the keys to ~/.ssh/authorized_keys, skipping
+// lines already there, with the permissions sshd's StrictModes expects.
+func installAuthorizedKeys(root, home string, uid, gid int, keyFiles []string) error {
+	sshDir, err := resolveInRoot(root, path.Join(home, ".ssh"))
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(sshDir, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create %s/.ssh: %w", home, err)
+	}
+	if err := os.Chown(sshDir, uid, gid); err != nil {
+		return err
+	}
+	if err := os.Chmod(sshDir, 0700); err != nil {
+		return err
+	}
+
+	keysPath := filepath.Join(sshDir, "authorized_keys")
+	if info, err := os.Lstat(keysPath); err == nil && !info.Mode().IsRegular() {
+		if err := os.Remove(keysPath); err != nil {
+			return err
+		}
+	}
+	existing, _ := os.ReadFile(keysPath)
+	seen := map[string]bool{}
+	lines := strings.Split(strings.TrimSpace(string(existing)), "\n")
+	for _, line := range lines {
+		seen[strings.TrimSpace(line)] = true
+	}
+	for _, file := range keyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") || seen[line] {
+				continue
+			}
+			if strings.Contains(line, "PRIVATE KEY") {
+				return fmt.Errorf("%s contains a private key; pass the .pub file", file)
+			}
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+
+	content := strings.TrimLeft(strings.Join(lines, "\n"), "\n") + "\n"
+	if err := os.WriteFile(keysPath, []byte(content), 0600); err != nil {
+		return fmt.Errorf("failed to write authorized_keys: %w", err)
+	}
+	if err := os.Chown(keysPath, uid, gid); err != nil {
+		return err
+	}
+	return os.Chmod(keysPath, 0600)
+}
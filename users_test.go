@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionAccessMalformedPasswd(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		passwd  string
+		group   string
+		wantErr string
+	}{
+		{"short entry", "root:x:0:0:root:/root:/bin/sh\napp:x:1000\n", "", "malformed /etc/passwd entry for app"},
+		{"bad uid", "root:x:0:0:root:/root:/bin/sh\napp:x:abc:1000:app:/home/app:/bin/sh\n", "", "invalid uid in /etc/passwd entry for app"},
+		{"short group entry", "root:x:0:0:root:/root:/bin/sh\n", "root:x:0:\napp:x\n", "malformed /etc/group entry for app"},
+		{"bad group gid", "root:x:0:0:root:/root:/bin/sh\n", "root:x:0:\napp:x:abc:\n", "invalid gid in /etc/group entry for app"},
+		{"valid", "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000:app:/home/app:/bin/sh\n", "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			etc := filepath.Join(dir, "rootfs", "etc")
+			if err := os.MkdirAll(etc, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(etc, "passwd"), []byte(tt.passwd), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.group != "" {
+				if err := os.WriteFile(filepath.Join(etc, "group"), []byte(tt.group), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctx := &ConversionContext{UnpackedPath: dir, NoColor: true, Access: &accessConfig{User: "app"}}
+			err := provisionAccess(ctx)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}